@@ -0,0 +1,89 @@
+package main
+
+import "container/list"
+
+const (
+	// DefaultCacheSize is the number of pages kept in memory when
+	// Options.CacheSize is not set.
+	DefaultCacheSize = 2000
+)
+
+// PageCache holds the pages the pager has loaded, ordered from most to least
+// recently used. It never drops a page by itself: the pager asks for a victim
+// once the cache is over capacity so that dirty pages can be written back
+// before they are removed.
+type PageCache struct {
+	Capacity int
+	pages    map[int32]*list.Element
+	lru      *list.List
+}
+
+func NewPageCache(capacity int) *PageCache {
+	if capacity <= 0 {
+		capacity = DefaultCacheSize
+	}
+	return &PageCache{
+		Capacity: capacity,
+		pages:    make(map[int32]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Get returns the cached page and marks it as most recently used, or nil if
+// the page is not resident.
+func (cache *PageCache) Get(pageNum int32) *Page {
+	elem, ok := cache.pages[pageNum]
+	if !ok {
+		return nil
+	}
+	cache.lru.MoveToFront(elem)
+	return elem.Value.(*Page)
+}
+
+func (cache *PageCache) Put(page *Page) {
+	if elem, ok := cache.pages[page.PageNum]; ok {
+		elem.Value = page
+		cache.lru.MoveToFront(elem)
+		return
+	}
+	cache.pages[page.PageNum] = cache.lru.PushFront(page)
+}
+
+func (cache *PageCache) Remove(pageNum int32) {
+	elem, ok := cache.pages[pageNum]
+	if !ok {
+		return
+	}
+	cache.lru.Remove(elem)
+	delete(cache.pages, pageNum)
+}
+
+func (cache *PageCache) Len() int {
+	return cache.lru.Len()
+}
+
+// Full reports whether the cache holds more pages than its capacity.
+func (cache *PageCache) Full() bool {
+	return cache.lru.Len() > cache.Capacity
+}
+
+// Victim returns the least recently used page that is not pinned, or nil if
+// every resident page is pinned.
+func (cache *PageCache) Victim() *Page {
+	for elem := cache.lru.Back(); elem != nil; elem = elem.Prev() {
+		page := elem.Value.(*Page)
+		if page.pinCount == 0 {
+			return page
+		}
+	}
+	return nil
+}
+
+// Pages returns every resident page, in no particular order.
+func (cache *PageCache) Pages() []*Page {
+	pages := make([]*Page, 0, cache.lru.Len())
+	for elem := cache.lru.Front(); elem != nil; elem = elem.Next() {
+		pages = append(pages, elem.Value.(*Page))
+	}
+	return pages
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Cell is a row as stored in a leaf page: its key, the size of its whole
+// payload, the part of the payload kept in the page and the first overflow
+// page holding the rest, 0 when the payload fits in the page.
+type Cell struct {
+	Key         int32
+	PayloadSize int32
+	Local       []byte
+	Overflow    int32
+}
+
+// Payload encodes the columns of row other than the key, each string as its
+// length followed by its bytes without the zero padding.
+func (row *Row) Payload() []byte {
+	name := bytes.TrimRight(row.Name[:], "\x00")
+	email := bytes.TrimRight(row.Email[:], "\x00")
+	payload := make([]byte, 4+len(name)+len(email))
+	binary.BigEndian.PutUint16(payload, uint16(len(name)))
+	copy(payload[2:], name)
+	binary.BigEndian.PutUint16(payload[2+len(name):], uint16(len(email)))
+	copy(payload[4+len(name):], email)
+	return payload
+}
+
+// RowFromPayload is the reverse of Row.Payload, it fails with a Corrupt
+// error if payload is not the payload of a row.
+func RowFromPayload(key int32, payload []byte) (Row, error) {
+	row := Row{ID: key}
+	for _, column := range [][]byte{row.Name[:], row.Email[:]} {
+		if len(payload) < 2 {
+			return Row{}, DBError{Corrupt}
+		}
+		n := int(binary.BigEndian.Uint16(payload))
+		if n > len(column) || n > len(payload)-2 {
+			return Row{}, DBError{Corrupt}
+		}
+		copy(column, payload[2:2+n])
+		payload = payload[2+n:]
+	}
+	return row, nil
+}
+
+// NewCell encodes row as a cell, its payload beyond MaxLocalPayload bytes is
+// written to new overflow pages.
+func (pager *Pager) NewCell(row Row) (Cell, error) {
+	payload := row.Payload()
+	cell := Cell{
+		Key:         row.ID,
+		PayloadSize: int32(len(payload)),
+		Local:       payload,
+	}
+	if len(payload) <= MaxLocalPayload {
+		return cell, nil
+	}
+	overflow, err := pager.writeOverflow(payload[MaxLocalPayload:])
+	if err != nil {
+		return Cell{}, err
+	}
+	cell.Local = payload[:MaxLocalPayload]
+	cell.Overflow = overflow
+	return cell, nil
+}
+
+// CellRow decodes the row of cell, following its overflow chain.
+func (pager *Pager) CellRow(cell Cell) (Row, error) {
+	return cellRow(pager, cell)
+}
+
+// cellRow is CellRow reading the overflow chain from pages. A Corrupt error
+// without a page number is one of the page that holds the cell.
+func cellRow(pages pageReader, cell Cell) (Row, error) {
+	payload := cell.Local
+	if cell.Overflow != 0 {
+		rest, err := readOverflow(pages, cell.Overflow, cell.PayloadSize-int32(len(cell.Local)))
+		if err != nil {
+			return Row{}, err
+		}
+		payload = append(payload[:len(payload):len(payload)], rest...)
+	}
+	if int32(len(payload)) != cell.PayloadSize {
+		return Row{}, DBError{Corrupt}
+	}
+	return RowFromPayload(cell.Key, payload)
+}
+
+// FreeCell releases the overflow pages of a cell being removed.
+func (pager *Pager) FreeCell(cell Cell) error {
+	if cell.Overflow == 0 {
+		return nil
+	}
+	return pager.freeOverflow(cell.Overflow)
+}
+
+// encode lays out cell as stored in a leaf page: the key, the payload size,
+// the local payload and, if the payload overflows, the first overflow page.
+func (cell *Cell) encode() []byte {
+	raw := make([]byte, CellHeaderSize+len(cell.Local), CellHeaderSize+len(cell.Local)+4)
+	binary.BigEndian.PutUint32(raw, uint32(cell.Key))
+	binary.BigEndian.PutUint16(raw[4:], uint16(cell.PayloadSize))
+	copy(raw[CellHeaderSize:], cell.Local)
+	if cell.Overflow != 0 {
+		raw = raw[:len(raw)+4]
+		binary.BigEndian.PutUint32(raw[len(raw)-4:], uint32(cell.Overflow))
+	}
+	return raw
+}
+
+// decodeCell is the reverse of Cell.encode, the local payload is copied out
+// of raw.
+func decodeCell(raw []byte) Cell {
+	payloadSize := int32(binary.BigEndian.Uint16(raw[4:]))
+	local := payloadSize
+	if local > MaxLocalPayload {
+		local = MaxLocalPayload
+	}
+	cell := Cell{
+		Key:         int32(binary.BigEndian.Uint32(raw)),
+		PayloadSize: payloadSize,
+		Local:       append([]byte(nil), raw[CellHeaderSize:CellHeaderSize+local]...),
+	}
+	if payloadSize > MaxLocalPayload {
+		cell.Overflow = int32(binary.BigEndian.Uint32(raw[CellHeaderSize+local:]))
+	}
+	return cell
+}
+
+// cellSize returns the size of the encoded cell at the start of raw.
+func cellSize(raw []byte) int32 {
+	return payloadCellSize(int32(binary.BigEndian.Uint16(raw[4:])))
+}
+
+// payloadCellSize returns the size of the encoded cell of a payload of
+// payloadSize bytes.
+func payloadCellSize(payloadSize int32) int32 {
+	if payloadSize > MaxLocalPayload {
+		return MaxCellSize
+	}
+	return CellHeaderSize + payloadSize
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// Every page, the header page included, ends with a CRC32C checksum of the
+// rest of the page and of the number of the page it belongs at, so that a
+// page damaged on disk, or written at the wrong place, is told apart from a
+// valid one. ToBytes computes it and the pager verifies it when it reads a
+// page, unless Options.SkipChecksumVerification is set.
+
+// PageChecksumSize is the size of the checksum at the end of every page.
+const PageChecksumSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func pageChecksum(pageNum int32, bs []byte) uint32 {
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], uint32(pageNum))
+	checksum := crc32.Update(0, castagnoli, prefix[:])
+	return crc32.Update(checksum, castagnoli, bs[:PageSize-PageChecksumSize])
+}
+
+// setChecksum stores at the end of bs, the image of page pageNum, the
+// checksum of the rest of it.
+func setChecksum(pageNum int32, bs []byte) {
+	binary.BigEndian.PutUint32(bs[PageSize-PageChecksumSize:], pageChecksum(pageNum, bs))
+}
+
+// verifyChecksum returns a Corrupt error if the checksum at the end of bs
+// does not match the content of page pageNum.
+func verifyChecksum(pageNum int32, bs []byte) error {
+	if binary.BigEndian.Uint32(bs[PageSize-PageChecksumSize:]) != pageChecksum(pageNum, bs) {
+		return corruptPage(pageNum)
+	}
+	return nil
+}
+
+// decodePage decodes bs, read from the place of page pageNum, checking its
+// checksum first if the pager verifies them.
+func (pager *Pager) decodePage(pageNum int32, bs [PageSize]byte) (Page, error) {
+	if pager.VerifyChecksums {
+		err := verifyChecksum(pageNum, bs[:])
+		if err != nil {
+			return Page{}, err
+		}
+	}
+	page, err := FromBytes(bs)
+	if err != nil || page.PageNum != pageNum {
+		return Page{}, corruptPage(pageNum)
+	}
+	return page, nil
+}
+
+// SetChecksumVerification turns the verification of the page checksums on or
+// off.
+func (table *Table) SetChecksumVerification(on bool) {
+	table.lock()
+	defer table.unlock()
+	table.options.SkipChecksumVerification = !on
+	table.Pager.VerifyChecksums = on
+}
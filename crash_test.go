@@ -0,0 +1,391 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errFault = errors.New("injected fault")
+
+// faultFS is an in-memory VFS that fails its nth write, sync or
+// truncate, and that can then simulate a crash, keeping of every file either
+// what was synced or everything written until the crash.
+type faultFS struct {
+	files map[string]*faultFile
+	// ops counts the writes, syncs and truncates, failAt is the one that
+	// fails, none if 0.
+	ops    int
+	failAt int
+	// crash makes every operation after the failing one fail as well, as if
+	// the process had died.
+	crash   bool
+	crashed bool
+	// tear makes the failing write write its first half.
+	tear bool
+}
+
+// faultFile is the content of a file, data as last written and synced as of
+// its last sync.
+type faultFile struct {
+	data   []byte
+	synced []byte
+}
+
+type faultHandle struct {
+	fs   *faultFS
+	file *faultFile
+}
+
+// crashMode is what a crash keeps of the writes that were not synced.
+type crashMode int
+
+const (
+	// crashLoseUnsynced loses them, as a power loss may.
+	crashLoseUnsynced crashMode = iota
+	// crashKeepWrites keeps them, as when only the process dies.
+	crashKeepWrites
+)
+
+func newFaultFS() *faultFS {
+	return &faultFS{files: make(map[string]*faultFile)}
+}
+
+// clone returns a copy of the files of fs, as synced.
+func (fs *faultFS) clone() *faultFS {
+	c := newFaultFS()
+	for path, file := range fs.files {
+		c.files[path] = &faultFile{
+			data:   append([]byte(nil), file.synced...),
+			synced: append([]byte(nil), file.synced...),
+		}
+	}
+	return c
+}
+
+// restart ends a crash: the files keep what mode tells, and operations
+// succeed again.
+func (fs *faultFS) restart(mode crashMode) {
+	for _, file := range fs.files {
+		if mode == crashLoseUnsynced {
+			file.data = append([]byte(nil), file.synced...)
+		} else {
+			file.synced = append([]byte(nil), file.data...)
+		}
+	}
+	fs.failAt = 0
+	fs.crashed = false
+}
+
+// fail counts an operation and tells whether it fails.
+func (fs *faultFS) fail() bool {
+	if fs.crashed {
+		return true
+	}
+	fs.ops++
+	if fs.ops != fs.failAt {
+		return false
+	}
+	fs.crashed = fs.crash
+	return true
+}
+
+func (fs *faultFS) Open(path string, create bool) (File, error) {
+	if fs.crashed {
+		return nil, errFault
+	}
+	file, ok := fs.files[path]
+	if !ok {
+		if !create {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		}
+		file = &faultFile{}
+		fs.files[path] = file
+	}
+	return &faultHandle{fs: fs, file: file}, nil
+}
+
+func (fs *faultFS) Delete(path string) error {
+	if fs.crashed {
+		return errFault
+	}
+	if _, ok := fs.files[path]; !ok {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	delete(fs.files, path)
+	return nil
+}
+
+func (fs *faultFS) Rename(oldPath, newPath string) error {
+	if fs.crashed {
+		return errFault
+	}
+	file, ok := fs.files[oldPath]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: oldPath, Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldPath)
+	fs.files[newPath] = file
+	return nil
+}
+
+func (fs *faultFS) Exists(path string) (bool, error) {
+	if fs.crashed {
+		return false, errFault
+	}
+	_, ok := fs.files[path]
+	return ok, nil
+}
+
+func (fs *faultFS) SyncDir(path string) error {
+	if fs.fail() {
+		return errFault
+	}
+	return nil
+}
+
+func (h *faultHandle) ReadAt(p []byte, off int64) (int, error) {
+	if h.fs.crashed {
+		return 0, errFault
+	}
+	if off >= int64(len(h.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, h.file.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *faultHandle) WriteAt(p []byte, off int64) (int, error) {
+	if h.fs.fail() {
+		if h.fs.tear {
+			h.write(p[:len(p)/2], off)
+		}
+		return 0, errFault
+	}
+	h.write(p, off)
+	return len(p), nil
+}
+
+func (h *faultHandle) write(p []byte, off int64) {
+	if end := off + int64(len(p)); end > int64(len(h.file.data)) {
+		h.file.data = append(h.file.data, make([]byte, end-int64(len(h.file.data)))...)
+	}
+	copy(h.file.data[off:], p)
+}
+
+func (h *faultHandle) Truncate(size int64) error {
+	if h.fs.fail() {
+		return errFault
+	}
+	if size <= int64(len(h.file.data)) {
+		h.file.data = h.file.data[:size]
+	} else {
+		h.file.data = append(h.file.data, make([]byte, size-int64(len(h.file.data)))...)
+	}
+	return nil
+}
+
+func (h *faultHandle) Sync() error {
+	if h.fs.fail() {
+		return errFault
+	}
+	h.file.synced = append([]byte(nil), h.file.data...)
+	return nil
+}
+
+func (h *faultHandle) Size() (int64, error) {
+	if h.fs.crashed {
+		return 0, errFault
+	}
+	return int64(len(h.file.data)), nil
+}
+
+func (h *faultHandle) Lock(level LockLevel) error {
+	return nil
+}
+
+func (h *faultHandle) Unlock(level LockLevel) error {
+	return nil
+}
+
+func (h *faultHandle) Close() error {
+	return nil
+}
+
+// crashScenario builds a database with setup, then changes it with run, which
+// must commit its changes.
+type crashScenario struct {
+	name  string
+	opts  Options
+	setup func(t *testing.T, table *Table)
+	run   func(table *Table) error
+}
+
+// selectAll returns the rows of the database of opts, checking its tree.
+func selectAll(t *testing.T, opts Options) []Row {
+	table, err := OpenDB(opts)
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	checkTree(t, table)
+	rows, err := table.SelectAll()
+	assert.Nil(t, err)
+	assert.Nil(t, table.Close())
+	return rows
+}
+
+// testCrashes fails every I/O operation of the run of scenario in turn, as a
+// crash in both crash modes, tearing the failing write or not, then as a
+// single error. Either way the reopened database must hold either the rows
+// from before run or those from after it.
+func testCrashes(t *testing.T, scenario crashScenario) {
+	base := newFaultFS()
+	opts := scenario.opts
+	opts.VFS = base
+	table, err := OpenDB(opts)
+	assert.Nil(t, err)
+	scenario.setup(t, table)
+	assert.Nil(t, table.Close())
+	before := selectAll(t, opts)
+
+	fs := base.clone()
+	opts.VFS = fs
+	table, err = OpenDB(opts)
+	assert.Nil(t, err)
+	start := fs.ops
+	assert.Nil(t, scenario.run(table))
+	ops := fs.ops - start
+	assert.Nil(t, table.Close())
+	after := selectAll(t, opts)
+	assert.NotEqual(t, before, after)
+
+	for failAt := 1; failAt <= ops; failAt++ {
+		for _, mode := range []crashMode{crashLoseUnsynced, crashKeepWrites} {
+			for _, tear := range []bool{false, true} {
+				fs := base.clone()
+				opts.VFS = fs
+				table, err := OpenDB(opts)
+				assert.Nil(t, err)
+				fs.failAt = fs.ops + failAt
+				fs.crash = true
+				fs.tear = tear
+				assert.NotNil(t, scenario.run(table), "%s: operation %d", scenario.name, failAt)
+				fs.restart(mode)
+				rows := selectAll(t, opts)
+				assert.True(t, assert.ObjectsAreEqual(before, rows) || assert.ObjectsAreEqual(after, rows),
+					"%s: crash at operation %d in mode %d, tear %v: %d rows", scenario.name, failAt, mode, tear, len(rows))
+			}
+		}
+
+		fs := base.clone()
+		opts.VFS = fs
+		table, err := OpenDB(opts)
+		assert.Nil(t, err)
+		fs.failAt = fs.ops + failAt
+		assert.NotNil(t, scenario.run(table), "%s: operation %d", scenario.name, failAt)
+		checkTree(t, table)
+		rows, err := table.SelectAll()
+		assert.Nil(t, err)
+		assert.Nil(t, table.Close(), "%s: error at operation %d", scenario.name, failAt)
+		assert.Equal(t, rows, selectAll(t, opts), "%s: error at operation %d", scenario.name, failAt)
+		assert.True(t, assert.ObjectsAreEqual(before, rows) || assert.ObjectsAreEqual(after, rows),
+			"%s: error at operation %d: %d rows", scenario.name, failAt, len(rows))
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	insertRows := func(from, to int32) func(t *testing.T, table *Table) {
+		return func(t *testing.T, table *Table) {
+			for i := from; i < to; i++ {
+				assert.Nil(t, table.InsertRow(paddedRow(i)))
+			}
+		}
+	}
+	execute := func(sqls ...string) func(table *Table) error {
+		return func(table *Table) error {
+			for _, sql := range sqls {
+				s, err := PrepareStatement(sql)
+				if err != nil {
+					return err
+				}
+				err = ExecuteStatement(table, *s)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	for _, mode := range []JournalMode{JournalDelete, JournalWAL} {
+		opts := Options{DBPath: "db.sqlite", JournalMode: mode}
+		scenarios := []crashScenario{
+			{
+				name:  "insert",
+				opts:  opts,
+				setup: insertRows(0, 5),
+				run:   execute("insert 10 john john@example.com"),
+			},
+			{
+				name:  "split",
+				opts:  opts,
+				setup: insertRows(0, RowsPerPage),
+				run:   execute("insert 100 john john@example.com"),
+			},
+			{
+				name:  "transaction",
+				opts:  opts,
+				setup: insertRows(0, 3*RowsPerPage),
+				run: func(table *Table) error {
+					// a small cache spills pages before the commit
+					table.Pager.Cache.Capacity = 2
+					tx, err := table.Begin()
+					if err != nil {
+						return err
+					}
+					for i := int32(1000); i < 1000+2*RowsPerPage; i++ {
+						err = table.InsertRow(paddedRow(i))
+						if err != nil {
+							tx.Rollback()
+							return err
+						}
+					}
+					_, err = table.DeleteRange(0, RowsPerPage)
+					if err != nil {
+						tx.Rollback()
+						return err
+					}
+					err = tx.Commit()
+					if err != nil {
+						tx.Rollback()
+					}
+					return err
+				},
+			},
+		}
+		if mode == JournalWAL {
+			scenarios = append(scenarios, crashScenario{
+				name:  "checkpoint",
+				opts:  opts,
+				setup: insertRows(0, 2*RowsPerPage),
+				run: func(table *Table) error {
+					err := execute("delete from users where id < 10")(table)
+					if err != nil {
+						return err
+					}
+					return table.Checkpoint()
+				},
+			})
+		}
+		for _, scenario := range scenarios {
+			scenario.name = fmt.Sprintf("%s in mode %d", scenario.name, mode)
+			testCrashes(t, scenario)
+		}
+	}
+}
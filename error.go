@@ -23,6 +23,26 @@ func (d DBError) Error() string {
 		msg = "Row not found"
 	case DBWriteFileError:
 		msg = "Write to db file fail"
+	case PageOutOfRange:
+		msg = "Page number out of range"
+	case NotADatabase:
+		msg = "File is not a database"
+	case UnsupportedFormat:
+		msg = "Unsupported database format version"
+	case DuplicateKey:
+		msg = "Duplicate key."
+	case TransactionActive:
+		msg = "Cannot start a transaction within a transaction"
+	case NoTransaction:
+		msg = "No transaction is active"
+	case NoSuchSavepoint:
+		msg = "No such savepoint"
+	case Busy:
+		msg = "Database is locked"
+	case SnapshotClosed:
+		msg = "Snapshot is closed"
+	case Corrupt:
+		msg = "Database disk image is malformed"
 	}
 	return fmt.Sprintf("DB error: (%d), %s", d.Code, msg)
 }
@@ -37,4 +57,42 @@ const (
 	DBFileError
 	RowNotFound
 	DBWriteFileError
-)
\ No newline at end of file
+	PageOutOfRange
+	NotADatabase
+	UnsupportedFormat
+	DuplicateKey
+	TransactionActive
+	NoTransaction
+	NoSuchSavepoint
+	Busy
+	SnapshotClosed
+	Corrupt
+)
+
+// CorruptError is the Corrupt error of a page that fails its checksum or
+// cannot be decoded.
+type CorruptError struct {
+	DBError
+	PageNum int32
+}
+
+func corruptPage(pageNum int32) CorruptError {
+	return CorruptError{DBError{Corrupt}, pageNum}
+}
+
+// onPage gives a Corrupt error that has no page number the number pageNum.
+func onPage(err error, pageNum int32) error {
+	if err == (DBError{Corrupt}) {
+		return corruptPage(pageNum)
+	}
+	return err
+}
+
+func (c CorruptError) Error() string {
+	return fmt.Sprintf("%s, page %d", c.DBError.Error(), c.PageNum)
+}
+
+// Is makes errors.Is match a CorruptError with DBError{Corrupt}.
+func (c CorruptError) Is(target error) bool {
+	return target == error(c.DBError)
+}
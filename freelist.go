@@ -0,0 +1,198 @@
+package main
+
+import "sort"
+
+// The free-page list is laid out as in SQLite: the header points to the
+// first trunk page, each trunk page holds the number of the next trunk and
+// the numbers of up to FreeLeavesPerTrunk free leaf pages, whose content is
+// meaningless.
+
+type FreeTrunkHeader struct {
+	NextTrunk int32
+	LeafCount int32
+}
+
+type FreeTrunkNode struct {
+	FreeTrunkHeader
+	Leaves [FreeLeavesPerTrunk]int32
+}
+
+// GetNewPageNum takes a page off the free-page list, or returns the page
+// past the end of the file when the list is empty.
+func (pager *Pager) GetNewPageNum() (int32, error) {
+	head := pager.Header.FreeListHead
+	if head == 0 {
+		return pager.PageNums, nil
+	}
+	trunk, err := pager.getTrunk(head)
+	if err != nil {
+		return 0, err
+	}
+	defer pager.Unpin(trunk)
+	pager.MarkDirty(trunk)
+	pager.Header.FreePageCount--
+	if trunk.LeafCount > 0 {
+		trunk.LeafCount--
+		pageNum := trunk.Leaves[trunk.LeafCount]
+		trunk.Leaves[trunk.LeafCount] = 0
+		return pageNum, nil
+	}
+	// a trunk without leaves is reused itself
+	pager.Header.FreeListHead = trunk.NextTrunk
+	return head, nil
+}
+
+// AllocatePage returns a new empty leaf page, pinned, reusing a free page
+// when there is one.
+func (pager *Pager) AllocatePage() (*Page, error) {
+	pageNum, err := pager.GetNewPageNum()
+	if err != nil {
+		return nil, err
+	}
+	if pageNum >= pager.PageNums {
+		return pager.GetPage(pageNum, true)
+	}
+	page, err := pager.GetPage(pageNum, false)
+	if err != nil {
+		return nil, err
+	}
+	pager.MarkDirty(page)
+	page.reset(Leaf)
+	return page, nil
+}
+
+// FreePage puts a page that is no longer part of the tree on the free-page
+// list, as a leaf of the first trunk or as the new first trunk if that one
+// is full.
+func (pager *Pager) FreePage(page *Page) error {
+	pager.MarkDirty(page)
+	page.reset(Free)
+	pager.Header.FreePageCount++
+	head := pager.Header.FreeListHead
+	if head != 0 {
+		trunk, err := pager.getTrunk(head)
+		if err != nil {
+			return err
+		}
+		defer pager.Unpin(trunk)
+		if trunk.LeafCount < FreeLeavesPerTrunk {
+			pager.MarkDirty(trunk)
+			trunk.Leaves[trunk.LeafCount] = page.PageNum
+			trunk.LeafCount++
+			return nil
+		}
+	}
+	page.NextTrunk = head
+	pager.Header.FreeListHead = page.PageNum
+	return nil
+}
+
+// getTrunk returns trunk page pageNum of the free-page list, pinned. A page
+// past the end of the database or that is not a trunk is corrupt.
+func (pager *Pager) getTrunk(pageNum int32) (*Page, error) {
+	trunk, err := pager.GetPage(pageNum, false)
+	if err != nil {
+		return nil, err
+	}
+	if trunk == nil || trunk.NodeType != Free {
+		pager.Unpin(trunk)
+		return nil, corruptPage(pageNum)
+	}
+	return trunk, nil
+}
+
+// freePageNums walks the free-page list and returns every page on it,
+// trunks included.
+func (pager *Pager) freePageNums() ([]int32, error) {
+	var pageNums []int32
+	for trunkNum := pager.Header.FreeListHead; trunkNum != 0; {
+		trunk, err := pager.getTrunk(trunkNum)
+		if err != nil {
+			return nil, err
+		}
+		pageNums = append(pageNums, trunkNum)
+		pageNums = append(pageNums, trunk.Leaves[:trunk.LeafCount]...)
+		trunkNum = trunk.NextTrunk
+		pager.Unpin(trunk)
+	}
+	return pageNums, nil
+}
+
+// releaseTrailingFreePages shrinks the database by the free pages found at
+// the end of the file, the free-page list is rebuilt from the pages left.
+func (pager *Pager) releaseTrailingFreePages() error {
+	pageNums, err := pager.freePageNums()
+	if err != nil {
+		return err
+	}
+	free := make(map[int32]bool, len(pageNums))
+	for _, pageNum := range pageNums {
+		free[pageNum] = true
+	}
+	pageCount := pager.PageNums
+	for pageCount > RootPageNum+1 && free[pageCount-1] {
+		pageCount--
+	}
+	if pageCount == pager.PageNums {
+		return nil
+	}
+	for pageNum := pageCount; pageNum < pager.PageNums; pageNum++ {
+		pager.Cache.Remove(pageNum)
+	}
+	pager.PageNums = pageCount
+	pager.Header.FreeListHead = 0
+	pager.Header.FreePageCount = 0
+	sort.Slice(pageNums, func(i, j int) bool {
+		return pageNums[i] < pageNums[j]
+	})
+	for _, pageNum := range pageNums {
+		if pageNum >= pageCount {
+			break
+		}
+		page, err := pager.GetPage(pageNum, false)
+		if err != nil {
+			return err
+		}
+		err = pager.FreePage(page)
+		pager.Unpin(page)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reset clears page to an empty page of the given type, keeping its cache
+// state.
+func (page *Page) reset(nodeType NodeType) {
+	*page = Page{
+		CommonNodeHeader: CommonNodeHeader{
+			NodeType: nodeType,
+			PageNum:  page.PageNum,
+		},
+		dirty:    page.dirty,
+		pinCount: page.pinCount,
+	}
+}
+
+// Stats describes the space used by the database file.
+type Stats struct {
+	PageCount     int32
+	FreePageCount int32
+	PagesWritten  int64
+	// Syncs counts the fsyncs made, see Synchronous.
+	Syncs int64
+}
+
+func (pager *Pager) Stats() Stats {
+	stats := Stats{
+		PageCount:     pager.PageNums,
+		FreePageCount: pager.Header.FreePageCount,
+		PagesWritten:  pager.PagesWritten,
+		Syncs:         pager.Syncs,
+	}
+	if pager.wal != nil {
+		stats.Syncs += pager.wal.Syncs
+	}
+	return stats
+}
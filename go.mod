@@ -2,7 +2,10 @@ module github.com/chowc/go_sqlite
 
 go 1.17
 
-require github.com/stretchr/testify v1.7.1
+require (
+	github.com/stretchr/testify v1.7.1
+	golang.org/x/sys v0.7.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.0 // indirect
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	// HeaderPageNum is the page holding the FileHeader, B+tree pages start
+	// right after it.
+	HeaderPageNum = int32(0)
+	// RootPageNum is the root of the table B+tree, it never moves: splitting
+	// the root copies its content into a new child instead.
+	RootPageNum = HeaderPageNum + 1
+	// FormatVersion is bumped whenever the on-disk layout changes, files
+	// written with another version are refused by OpenDB.
+	FormatVersion = uint32(4)
+)
+
+var HeaderMagic = [16]byte{'g', 'o', '_', 's', 'q', 'l', 'i', 't', 'e', ' ', 'f', 'o', 'r', 'm', 'a', 't'}
+
+// FileHeader is stored at the start of page 0 of every database file.
+type FileHeader struct {
+	Magic         [16]byte
+	FormatVersion uint32
+	PageSize      uint32
+	// PageCount includes the header page itself.
+	PageCount int32
+	// FreeListHead is the first trunk page of the free-page list, 0 if
+	// the list is empty.
+	FreeListHead int32
+	// FreePageCount is the number of pages on the free-page list, trunks
+	// included.
+	FreePageCount int32
+	// SchemaCookie changes whenever the schema changes.
+	SchemaCookie uint32
+	// ChangeCounter is incremented every time the file is flushed.
+	ChangeCounter uint32
+}
+
+func NewFileHeader() FileHeader {
+	return FileHeader{
+		Magic:         HeaderMagic,
+		FormatVersion: FormatVersion,
+		PageSize:      PageSize,
+		PageCount:     1,
+	}
+}
+
+func (header *FileHeader) ToBytes() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := binary.Write(buf, binary.BigEndian, header)
+	if err != nil {
+		return nil, err
+	}
+	bs := make([]byte, PageSize)
+	copy(bs, buf.Bytes())
+	setChecksum(HeaderPageNum, bs)
+	return bs, nil
+}
+
+// HeaderFromBytes decodes and validates the header page.
+func HeaderFromBytes(bs []byte) (FileHeader, error) {
+	var header FileHeader
+	err := binary.Read(bytes.NewReader(bs), binary.BigEndian, &header)
+	if err != nil || header.Magic != HeaderMagic {
+		return header, DBError{NotADatabase}
+	}
+	if header.FormatVersion != FormatVersion || header.PageSize != PageSize {
+		return header, DBError{UnsupportedFormat}
+	}
+	if header.PageCount < 1 || header.FreeListHead < 0 || header.FreeListHead >= header.PageCount {
+		return header, DBError{NotADatabase}
+	}
+	return header, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+)
+
+// The rollback journal holds the original content of every page the current
+// transaction overwrites in the database file. It starts with a
+// JournalHeader, followed by one record per page: the page number, the page
+// image and a checksum of both salted with the header nonce. The journal is
+// synced before the database file is first modified and deleted once the
+// transaction is committed, so a journal found when the database is opened
+// means a transaction was interrupted, and replaying it restores the database
+// as it was before that transaction.
+
+var JournalMagic = [8]byte{'g', 'o', 's', 'q', 'l', 'j', 'r', 'n'}
+
+type JournalHeader struct {
+	Magic [8]byte
+	// PageCount is the number of pages of the database file before the
+	// transaction, the file is truncated back to it on rollback.
+	PageCount int32
+	Nonce     uint32
+}
+
+var journalHeaderSize = int64(binary.Size(JournalHeader{}))
+
+const journalRecordSize = 4 + PageSize + 4
+
+func journalPath(dbPath string) string {
+	return dbPath + "-journal"
+}
+
+// journalChecksum returns the checksum of the record of page pageNum.
+func journalChecksum(nonce uint32, pageNum int32, data []byte) uint32 {
+	var prefix [8]byte
+	binary.BigEndian.PutUint32(prefix[:], nonce)
+	binary.BigEndian.PutUint32(prefix[4:], uint32(pageNum))
+	return crc32.Update(crc32.ChecksumIEEE(prefix[:]), crc32.IEEETable, data)
+}
+
+// openJournal starts the journal of a transaction, recording the size of the
+// database file before any page of it is modified.
+func (pager *Pager) openJournal() error {
+	if pager.journal != nil {
+		return nil
+	}
+	file, err := pager.vfs.Open(pager.journalPath, true)
+	if err != nil {
+		return DBError{DBFileError}
+	}
+	err = file.Truncate(0)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	header := JournalHeader{
+		Magic:     JournalMagic,
+		PageCount: pager.dbSize,
+		Nonce:     rand.Uint32(),
+	}
+	buf := &bytes.Buffer{}
+	err = binary.Write(buf, binary.BigEndian, header)
+	if err == nil {
+		_, err = file.WriteAt(buf.Bytes(), 0)
+	}
+	if err != nil {
+		file.Close()
+		pager.vfs.Delete(pager.journalPath)
+		return err
+	}
+	err = pager.syncDir(pager.journalPath)
+	if err != nil {
+		file.Close()
+		pager.vfs.Delete(pager.journalPath)
+		return err
+	}
+	pager.journal = file
+	pager.journalHeader = header
+	pager.journalSize = journalHeaderSize
+	pager.journaled = make(map[int32]bool)
+	pager.journalSynced = false
+	return nil
+}
+
+// journalPages appends to the journal the original content of the pages
+// about to be overwritten that are not in it yet, and syncs it so that the
+// journal always holds them before the database file changes.
+func (pager *Pager) journalPages(pageNums []int32) error {
+	err := pager.openJournal()
+	if err != nil {
+		return err
+	}
+	record := make([]byte, journalRecordSize)
+	for _, pageNum := range pageNums {
+		if pageNum >= pager.dbSize || pager.journaled[pageNum] {
+			continue
+		}
+		data := record[4 : 4+PageSize]
+		_, err := pager.File.ReadAt(data, int64(PageSize)*int64(pageNum))
+		if err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(record, uint32(pageNum))
+		binary.BigEndian.PutUint32(record[4+PageSize:], journalChecksum(pager.journalHeader.Nonce, pageNum, data))
+		_, err = pager.journal.WriteAt(record, pager.journalSize)
+		if err != nil {
+			return err
+		}
+		pager.journalSize += journalRecordSize
+		pager.journaled[pageNum] = true
+		pager.journalSynced = false
+	}
+	if pager.journalSynced {
+		return nil
+	}
+	err = pager.sync(pager.journal)
+	if err != nil {
+		return err
+	}
+	pager.journalSynced = true
+	return nil
+}
+
+// commitJournal ends the transaction once the database file is synced:
+// deleting the journal is what makes the transaction durable.
+func (pager *Pager) commitJournal() error {
+	pager.dbSize = pager.PageNums
+	if pager.journal == nil {
+		return nil
+	}
+	pager.journal.Close()
+	pager.journal = nil
+	pager.journaled = nil
+	err := pager.vfs.Delete(pager.journalPath)
+	if err != nil {
+		return DBError{DBFileError}
+	}
+	return pager.syncDir(pager.journalPath)
+}
+
+// recoverJournal rolls back the transaction left by a crash, if a journal is
+// found next to the database file. A journal too short to hold its header
+// was never synced, so the database file was not modified yet.
+func (pager *Pager) recoverJournal() error {
+	file, err := pager.vfs.Open(pager.journalPath, false)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return DBError{DBFileError}
+	}
+	defer file.Close()
+	var header JournalHeader
+	err = binary.Read(io.NewSectionReader(file, 0, journalHeaderSize), binary.BigEndian, &header)
+	if err == nil && header.Magic == JournalMagic {
+		err = pager.replayJournal(file, header)
+		if err != nil {
+			return err
+		}
+	}
+	file.Close()
+	err = pager.vfs.Delete(pager.journalPath)
+	if err != nil {
+		return DBError{DBFileError}
+	}
+	return pager.syncDir(pager.journalPath)
+}
+
+// replayJournal writes back the pages recorded in the journal, stopping at
+// the first incomplete or corrupted record, and truncates the database file
+// to its size before the transaction.
+func (pager *Pager) replayJournal(file File, header JournalHeader) error {
+	record := make([]byte, journalRecordSize)
+	for offset := journalHeaderSize; ; offset += journalRecordSize {
+		_, err := file.ReadAt(record, offset)
+		if err != nil {
+			break
+		}
+		pageNum := int32(binary.BigEndian.Uint32(record))
+		data := record[4 : 4+PageSize]
+		if pageNum < 0 || pageNum >= header.PageCount ||
+			binary.BigEndian.Uint32(record[4+PageSize:]) != journalChecksum(header.Nonce, pageNum, data) {
+			break
+		}
+		_, err = pager.File.WriteAt(data, int64(PageSize)*int64(pageNum))
+		if err != nil {
+			return err
+		}
+	}
+	err := pager.File.Truncate(int64(PageSize) * int64(header.PageCount))
+	if err != nil {
+		return err
+	}
+	err = pager.sync(pager.File)
+	if err != nil {
+		return err
+	}
+	pager.FileLength = int64(PageSize) * int64(header.PageCount)
+	return nil
+}
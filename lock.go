@@ -0,0 +1,214 @@
+package main
+
+import "time"
+
+// Connections to the same database, from the same process or not, take
+// SQLite's locks on the database file. Reading takes a shared lock, kept for
+// as long as snapshots are open or, in a transaction, until the next commit
+// or rollback, and a connection that first reads after another one committed
+// drops its cache, which it tells from the change counter of the header.
+// Writing takes a reserved lock, of which there is one at a time, and writing
+// the database file an exclusive lock, which waits for the readers to leave.
+// In WAL mode writers only append to the log, the exclusive lock is only
+// taken by checkpoints, and each connection also holds a shared lock on the
+// log for as long as it is open, so that the last one to close it knows it
+// can remove it.
+
+// busyWait calls try until it does not fail with a Busy error, sleeping a
+// growing delay between calls, for up to the busy timeout.
+func (pager *Pager) busyWait(try func() error) error {
+	deadline := time.Now().Add(pager.BusyTimeout)
+	delay := time.Millisecond
+	for {
+		err := try()
+		if err != (DBError{Busy}) {
+			return err
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return err
+		}
+		if wait > delay {
+			wait = delay
+		}
+		time.Sleep(wait)
+		if delay < 100*time.Millisecond {
+			delay *= 2
+		}
+	}
+}
+
+// tryLock raises the lock on the database file to level, failing at once if
+// another connection holds a conflicting lock.
+func (pager *Pager) tryLock(level LockLevel) error {
+	if level <= pager.lockLevel {
+		return nil
+	}
+	err := pager.File.Lock(level)
+	if err != nil {
+		return err
+	}
+	pager.lockLevel = level
+	return nil
+}
+
+// lock raises the lock on the database file to level, waiting for up to the
+// busy timeout while another connection holds a conflicting lock.
+func (pager *Pager) lock(level LockLevel) error {
+	return pager.busyWait(func() error {
+		return pager.tryLock(level)
+	})
+}
+
+// unlock lowers the lock on the database file to level. The file is always
+// asked to, as a lock that was not granted may have left it with a pending
+// lock.
+func (pager *Pager) unlock(level LockLevel) error {
+	if level < pager.lockLevel {
+		pager.lockLevel = level
+	}
+	return pager.File.Unlock(level)
+}
+
+// beginRead takes the shared lock needed to read the database.
+func (pager *Pager) beginRead() error {
+	if pager.lockLevel >= LockShared {
+		return nil
+	}
+	return pager.busyWait(pager.startRead)
+}
+
+// startRead takes the shared lock, rolls back the transaction of a
+// connection that crashed, catches up with the transactions committed to the
+// WAL by other connections and drops the cache if the database changed since
+// it was filled.
+func (pager *Pager) startRead() error {
+	err := pager.tryLock(LockShared)
+	if err != nil {
+		return err
+	}
+	err = pager.recoverHotJournal()
+	if err == nil && pager.wal != nil {
+		_, err = pager.wal.refresh()
+	}
+	if err == nil {
+		err = pager.validateCache()
+	}
+	if err != nil {
+		pager.unlock(LockNone)
+		return err
+	}
+	return nil
+}
+
+// beginWrite takes the reserved lock needed to modify the database. A
+// connection that holds no lock yet does not keep its shared lock while it
+// waits, so that the writer it waits for can get its exclusive lock.
+func (pager *Pager) beginWrite() error {
+	if pager.lockLevel >= LockReserved {
+		return nil
+	}
+	var err error
+	if pager.lockLevel == LockNone {
+		err = pager.busyWait(func() error {
+			err := pager.startRead()
+			if err != nil {
+				return err
+			}
+			err = pager.tryLock(LockReserved)
+			if err != nil {
+				pager.unlock(LockNone)
+			}
+			return err
+		})
+	} else {
+		err = pager.lock(LockReserved)
+	}
+	if err != nil || pager.wal == nil {
+		return err
+	}
+	// in WAL mode another connection may have committed since the shared
+	// lock was taken
+	index := pager.wal.index
+	_, err = pager.wal.refresh()
+	if err == nil {
+		err = pager.preserveCommitted(index)
+	}
+	if err != nil {
+		return err
+	}
+	return pager.validateCache()
+}
+
+// endTransaction releases the locks on the database file, but for the shared
+// lock of the open snapshots. The cache is kept for as long as no other
+// connection commits.
+func (pager *Pager) endTransaction() error {
+	if len(pager.snapshots) > 0 {
+		return pager.unlock(LockShared)
+	}
+	return pager.unlock(LockNone)
+}
+
+// recoverHotJournal rolls back the transaction left by a connection that
+// crashed, if the database has a journal no connection holds the reserved
+// lock for.
+func (pager *Pager) recoverHotJournal() error {
+	exists, err := pager.vfs.Exists(pager.journalPath)
+	if err != nil || !exists {
+		return err
+	}
+	err = pager.tryLock(LockReserved)
+	if err == (DBError{Busy}) {
+		// the journal is the one of a live writer
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = pager.lock(LockExclusive)
+	if err == nil {
+		err = pager.recoverJournal()
+	}
+	unlockErr := pager.unlock(LockShared)
+	if err == nil {
+		err = unlockErr
+	}
+	pager.loaded = false
+	return err
+}
+
+// validateCache reloads the header, dropping the cache, if another
+// connection committed since they were read.
+func (pager *Pager) validateCache() error {
+	if pager.memory != nil && pager.loaded {
+		// nothing but the cache holds the database
+		return nil
+	}
+	size, err := pager.File.Size()
+	if err != nil {
+		return DBError{DBFileError}
+	}
+	pager.FileLength = size
+	if pager.loaded {
+		var header FileHeader
+		if size > 0 || pager.wal != nil && pager.wal.commitSize > 0 {
+			bs := make([]byte, PageSize)
+			err = pager.readHeaderPage(bs)
+			if err != nil {
+				return err
+			}
+			header, _ = HeaderFromBytes(bs)
+		}
+		if header.ChangeCounter == pager.Header.ChangeCounter {
+			return nil
+		}
+	}
+	pager.Cache = NewPageCache(pager.Cache.Capacity)
+	err = pager.readHeader()
+	if err != nil {
+		return err
+	}
+	pager.loaded = true
+	return nil
+}
@@ -0,0 +1,9 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// setLockCmd is F_OFD_SETLK: open file description locks belong to the open
+// file rather than to the process, so two connections of the same process
+// exclude each other too, and closing one does not release the locks of the
+// other.
+const setLockCmd = unix.F_OFD_SETLK
@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+const (
+	lockRead = iota
+	lockWrite
+	lockUnlock
+)
+
+// setLock does nothing where advisory locks are not supported, a single
+// process must access the database then.
+func (f *osFile) setLock(typ int16, start int64, n int64) error {
+	return nil
+}
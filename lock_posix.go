@@ -0,0 +1,10 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd netbsd openbsd solaris
+
+package main
+
+import "syscall"
+
+// setLockCmd is F_SETLK, whose locks belong to the process: they only keep
+// other processes out.
+const setLockCmd = syscall.F_SETLK
@@ -0,0 +1,29 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import "syscall"
+
+const (
+	lockRead   = syscall.F_RDLCK
+	lockWrite  = syscall.F_WRLCK
+	lockUnlock = syscall.F_UNLCK
+)
+
+// setLock sets an advisory lock of type typ on the n bytes of f at start, 0
+// meaning up to the end of the file. A lock held by another file description
+// is reported as Busy.
+func (f *osFile) setLock(typ int16, start int64, n int64) error {
+	lock := syscall.Flock_t{
+		Type:   typ,
+		Whence: 0,
+		Start:  start,
+		Len:    n,
+	}
+	err := syscall.FcntlFlock(f.Fd(), setLockCmd, &lock)
+	if err == syscall.EAGAIN || err == syscall.EACCES {
+		return DBError{Busy}
+	}
+	return err
+}
@@ -2,19 +2,24 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func main() {
 	var dbPath string
-	flag.StringVar(&dbPath, "file", "db.sqlite", "the db file")
+	var busyTimeout time.Duration
+	flag.StringVar(&dbPath, "file", "db.sqlite", "the db file, "+MemoryDBPath+" for an in-memory database")
+	flag.DurationVar(&busyTimeout, "busy-timeout", 5*time.Second, "how long to wait for the locks of other connections")
 	flag.Parse()
 
-	table, err := OpenDB(Options{dbPath})
+	table, err := OpenDB(Options{DBPath: dbPath, BusyTimeout: busyTimeout})
 	if err != nil {
 		fmt.Printf("OpenDB fail:%v\n", err)
 		os.Exit(1)
@@ -44,6 +49,10 @@ func main() {
 			continue
 		}
 		err = ExecuteStatement(table, *s)
+		if errors.Is(err, DBError{DuplicateKey}) {
+			fmt.Println("Error: Duplicate key.")
+			continue
+		}
 		if err != nil {
 			fmt.Printf("%v\n", err)
 			continue
@@ -57,13 +66,54 @@ type StatementType int
 const (
 	StatementSelect StatementType = iota
 	StatementInsert
+	StatementDelete
+	StatementUpdate
+	StatementVacuum
+	StatementBegin
+	StatementCommit
+	StatementRollback
+	StatementSavepoint
+	StatementRelease
+	StatementRollbackTo
+	StatementPragma
+)
+
+// Column is a bit set of the columns of Row.
+type Column int
+
+const (
+	ColumnID Column = 1 << iota
+	ColumnName
+	ColumnEmail
 )
 
 type Statement struct {
 	StatementType StatementType
 	Row           Row
+	// Where is the range of keys selected by the WHERE clause.
+	Where KeyRange
+	// Set are the columns an UPDATE assigns, their new values are in Row.
+	Set Column
+	// OnConflict is the conflict resolution of an INSERT.
+	OnConflict ConflictMode
+	// Savepoint is the name of the savepoint of a SAVEPOINT, RELEASE or
+	// ROLLBACK TO.
+	Savepoint string
+	// Pragma is the name of the setting of a PRAGMA, PragmaValue the value
+	// it is set to, empty when the PRAGMA only reads it.
+	Pragma      string
+	PragmaValue string
+}
+
+// KeyRange is an inclusive range of keys, it is empty if Low > High.
+type KeyRange struct {
+	Low  int32
+	High int32
 }
 
+// FullRange matches every key, it is used when there is no WHERE clause.
+var FullRange = KeyRange{Low: math.MinInt32, High: math.MaxInt32}
+
 type MetaCommandResult int
 
 const (
@@ -84,6 +134,15 @@ func DoMetaCommand(table *Table, line string) (MetaCommandResult, error) {
 	case ".BTREE":
 		table.printTree(table.RootPageNum, 0)
 		return MetaCommandSuccess, nil
+	case ".STATS":
+		stats := table.Pager.Stats()
+		fmt.Printf("pages: %d\n", stats.PageCount)
+		fmt.Printf("free pages: %d\n", stats.FreePageCount)
+		return MetaCommandSuccess, nil
+	case ".VACUUM":
+		return MetaCommandSuccess, table.Vacuum()
+	case ".CHECKPOINT":
+		return MetaCommandSuccess, table.Checkpoint()
 	}
 	return MetaCommandUnknown, nil
 }
@@ -96,6 +155,19 @@ func PrepareStatement(line string) (*Statement, error) {
 	switch strings.ToUpper(ss[0]) {
 	case "INSERT":
 		// insert 1 john john@example.com
+		// insert or replace 1 john john@example.com
+		onConflict := ConflictAbort
+		if len(ss) > 2 && strings.ToUpper(ss[1]) == "OR" {
+			switch strings.ToUpper(ss[2]) {
+			case "REPLACE":
+				onConflict = ConflictReplace
+			case "IGNORE":
+				onConflict = ConflictIgnore
+			default:
+				return nil, DBError{InvalidStatement}
+			}
+			ss = ss[2:]
+		}
 		if len(ss) < 4 {
 			return nil, DBError{InvalidStatement}
 		}
@@ -121,18 +193,302 @@ func PrepareStatement(line string) (*Statement, error) {
 		return &Statement{
 			StatementType: StatementInsert,
 			Row:           row,
+			OnConflict:    onConflict,
 		}, nil
 	case "SELECT":
 		return &Statement{
 			StatementType: StatementSelect,
 		}, nil
+	case "DELETE":
+		// delete from users where id >= 1 and id < 10
+		tokens := tokenize(line)
+		if len(tokens) < 3 || strings.ToUpper(tokens[1]) != "FROM" {
+			return nil, DBError{InvalidStatement}
+		}
+		where, err := parseWhere(tokens[3:])
+		if err != nil {
+			return nil, err
+		}
+		return &Statement{
+			StatementType: StatementDelete,
+			Where:         where,
+		}, nil
+	case "UPDATE":
+		// update users set name = john, email = 'john@example.com' where id = 1
+		tokens := tokenize(line)
+		if len(tokens) < 6 || strings.ToUpper(tokens[2]) != "SET" {
+			return nil, DBError{InvalidStatement}
+		}
+		s := &Statement{StatementType: StatementUpdate}
+		tokens = tokens[3:]
+		for {
+			if len(tokens) < 3 || tokens[1] != "=" {
+				return nil, DBError{InvalidStatement}
+			}
+			err := s.assign(tokens[0], unquote(tokens[2]))
+			if err != nil {
+				return nil, err
+			}
+			tokens = tokens[3:]
+			if len(tokens) == 0 || tokens[0] != "," {
+				break
+			}
+			tokens = tokens[1:]
+		}
+		where, err := parseWhere(tokens)
+		if err != nil {
+			return nil, err
+		}
+		s.Where = where
+		return s, nil
+	case "VACUUM":
+		if len(ss) != 1 {
+			return nil, DBError{InvalidStatement}
+		}
+		return &Statement{
+			StatementType: StatementVacuum,
+		}, nil
+	case "SAVEPOINT":
+		// savepoint name
+		if len(ss) != 2 {
+			return nil, DBError{InvalidStatement}
+		}
+		return &Statement{
+			StatementType: StatementSavepoint,
+			Savepoint:     ss[1],
+		}, nil
+	case "RELEASE":
+		// release [savepoint] name
+		name, ok := savepointName(ss[1:])
+		if !ok {
+			return nil, DBError{InvalidStatement}
+		}
+		return &Statement{
+			StatementType: StatementRelease,
+			Savepoint:     name,
+		}, nil
+	case "PRAGMA":
+		// pragma synchronous [= normal]
+		tokens := tokenize(line)
+		if len(tokens) != 2 && (len(tokens) != 4 || tokens[2] != "=") {
+			return nil, DBError{InvalidStatement}
+		}
+		s := &Statement{
+			StatementType: StatementPragma,
+			Pragma:        strings.ToLower(tokens[1]),
+		}
+		if s.Pragma != "synchronous" {
+			return nil, DBError{InvalidStatement}
+		}
+		if len(tokens) == 4 {
+			s.PragmaValue = unquote(tokens[3])
+			_, err := ParseSynchronous(s.PragmaValue)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	case "BEGIN", "COMMIT", "END", "ROLLBACK":
+		if s, ok := rollbackTo(ss); ok {
+			return s, nil
+		}
+		// begin [transaction]
+		if len(ss) > 2 || len(ss) == 2 && strings.ToUpper(ss[1]) != "TRANSACTION" {
+			return nil, DBError{InvalidStatement}
+		}
+		statementType := map[string]StatementType{
+			"BEGIN":    StatementBegin,
+			"COMMIT":   StatementCommit,
+			"END":      StatementCommit,
+			"ROLLBACK": StatementRollback,
+		}[strings.ToUpper(ss[0])]
+		return &Statement{
+			StatementType: statementType,
+		}, nil
 	}
 	return nil, DBError{InvalidStatement}
 }
 
+// rollbackTo parses "rollback [transaction] to [savepoint] name", it returns
+// false if ss is not a ROLLBACK TO.
+func rollbackTo(ss []string) (*Statement, bool) {
+	if strings.ToUpper(ss[0]) != "ROLLBACK" {
+		return nil, false
+	}
+	words := ss[1:]
+	if len(words) > 0 && strings.ToUpper(words[0]) == "TRANSACTION" {
+		words = words[1:]
+	}
+	if len(words) == 0 || strings.ToUpper(words[0]) != "TO" {
+		return nil, false
+	}
+	name, ok := savepointName(words[1:])
+	if !ok {
+		return nil, false
+	}
+	return &Statement{
+		StatementType: StatementRollbackTo,
+		Savepoint:     name,
+	}, true
+}
+
+// savepointName returns the name in "[savepoint] name".
+func savepointName(words []string) (string, bool) {
+	if len(words) == 2 && strings.ToUpper(words[0]) == "SAVEPOINT" {
+		words = words[1:]
+	}
+	if len(words) != 1 {
+		return "", false
+	}
+	return words[0], true
+}
+
+// assign records the SET of column to value in an UPDATE statement.
+func (s *Statement) assign(column string, value string) error {
+	switch strings.ToLower(column) {
+	case "id":
+		id, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return DBError{InvalidStatement}
+		}
+		s.Row.ID = int32(id)
+		s.Set |= ColumnID
+	case "name":
+		if len(value) > 32 {
+			return DBError{NameTooLong}
+		}
+		copy(s.Row.Name[:], value)
+		s.Set |= ColumnName
+	case "email":
+		if len(value) > 256 {
+			return DBError{EmailTooLong}
+		}
+		copy(s.Row.Email[:], value)
+		s.Set |= ColumnEmail
+	default:
+		return DBError{InvalidStatement}
+	}
+	return nil
+}
+
+// unquote strips the quotes of a string literal.
+func unquote(token string) string {
+	if len(token) >= 2 && (token[0] == '\'' || token[0] == '"') && token[len(token)-1] == token[0] {
+		return token[1 : len(token)-1]
+	}
+	return token
+}
+
+// tokenize splits a statement into words, numbers, quoted strings and the
+// punctuation of WHERE and SET clauses, so "id>=1" and "id >= 1" read alike.
+func tokenize(line string) []string {
+	var tokens []string
+	line = strings.TrimSpace(line)
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == ',':
+			tokens = append(tokens, ",")
+			i++
+		case strings.IndexByte("<>=!", c) >= 0:
+			j := i + 1
+			for j < len(line) && strings.IndexByte("<>=", line[j]) >= 0 {
+				j++
+			}
+			tokens = append(tokens, line[i:j])
+			i = j
+		case c == '\'' || c == '"':
+			j := i + 1
+			for j < len(line) && line[j] != c {
+				j++
+			}
+			if j < len(line) {
+				j++
+			}
+			tokens = append(tokens, line[i:j])
+			i = j
+		default:
+			j := i + 1
+			for j < len(line) && strings.IndexByte(" \t\n\r,<>=!'\"", line[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, line[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+// parseWhere parses an optional "WHERE id <op> <n> [AND id <op> <n> ...]"
+// clause into the range of keys it selects.
+func parseWhere(tokens []string) (KeyRange, error) {
+	if len(tokens) == 0 {
+		return FullRange, nil
+	}
+	if strings.ToUpper(tokens[0]) != "WHERE" {
+		return KeyRange{}, DBError{InvalidStatement}
+	}
+	low, high := int64(math.MinInt32), int64(math.MaxInt32)
+	tokens = tokens[1:]
+	for {
+		if len(tokens) < 3 || strings.ToLower(tokens[0]) != "id" {
+			return KeyRange{}, DBError{InvalidStatement}
+		}
+		value, err := strconv.ParseInt(tokens[2], 10, 32)
+		if err != nil {
+			return KeyRange{}, DBError{InvalidStatement}
+		}
+		switch tokens[1] {
+		case "=":
+			low, high = max64(low, value), min64(high, value)
+		case ">":
+			low = max64(low, value+1)
+		case ">=":
+			low = max64(low, value)
+		case "<":
+			high = min64(high, value-1)
+		case "<=":
+			high = min64(high, value)
+		default:
+			return KeyRange{}, DBError{InvalidStatement}
+		}
+		tokens = tokens[3:]
+		if len(tokens) == 0 {
+			break
+		}
+		if strings.ToUpper(tokens[0]) != "AND" {
+			return KeyRange{}, DBError{InvalidStatement}
+		}
+		tokens = tokens[1:]
+	}
+	if low > high {
+		// nothing matches, keep the bounds within int32
+		return KeyRange{Low: 1, High: 0}, nil
+	}
+	return KeyRange{Low: int32(low), High: int32(high)}, nil
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// ExecuteStatement runs s. Outside a transaction started by BEGIN the
+// statement is committed when it succeeds and rolled back when it fails.
+// Statements that write run one at a time, a SELECT reads a snapshot.
 func ExecuteStatement(table *Table, s Statement) error {
-	switch s.StatementType {
-	case StatementSelect:
+	if s.StatementType == StatementSelect {
 		rows, err := table.SelectAll()
 		if err != nil {
 			return err
@@ -140,11 +496,118 @@ func ExecuteStatement(table *Table, s Statement) error {
 		for _, row := range rows {
 			fmt.Printf("(%d, %s, %s)\n", row.ID, row.Name, row.Email)
 		}
+		return nil
+	}
+	table.lock()
+	defer table.unlock()
+	switch s.StatementType {
+	case StatementBegin:
+		_, err := table.begin()
+		return err
+	case StatementCommit:
+		if table.tx == nil {
+			return DBError{NoTransaction}
+		}
+		return table.tx.commit()
+	case StatementRollback:
+		if table.tx == nil {
+			return DBError{NoTransaction}
+		}
+		return table.tx.rollback()
+	case StatementSavepoint:
+		return table.savepoint(s.Savepoint)
+	case StatementRelease:
+		if table.tx == nil {
+			return DBError{NoSuchSavepoint}
+		}
+		return table.tx.release(s.Savepoint)
+	case StatementRollbackTo:
+		if table.tx == nil {
+			return DBError{NoSuchSavepoint}
+		}
+		return table.tx.rollbackTo(s.Savepoint)
+	case StatementVacuum:
+		return table.vacuum()
+	case StatementPragma:
+		return executePragma(table, s)
+	}
+	err := executeStatement(table, s)
+	if table.tx != nil {
+		return err
+	}
+	if err != nil {
+		rollbackErr := table.Pager.Rollback()
+		if rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+	return table.Pager.Flush()
+}
+
+func executeStatement(table *Table, s Statement) error {
+	switch s.StatementType {
 	case StatementInsert:
-		return table.InsertRow(s.Row)
+		return table.insertRowOnConflict(s.Row, s.OnConflict)
+	case StatementDelete:
+		n, err := table.deleteRange(s.Where.Low, s.Where.High)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d rows affected\n", n)
+	case StatementUpdate:
+		n, err := executeUpdate(table, s)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d rows affected\n", n)
 	default:
 		return DBError{InvalidStatement}
 	}
 	return nil
 }
 
+// executePragma sets the setting of a PRAGMA, or prints it if no value is
+// given.
+func executePragma(table *Table, s Statement) error {
+	if s.PragmaValue == "" {
+		fmt.Println(table.Pager.Synchronous.Level())
+		return nil
+	}
+	level, err := ParseSynchronous(s.PragmaValue)
+	if err != nil {
+		return err
+	}
+	table.setSynchronous(level)
+	return nil
+}
+
+// executeUpdate applies the SET columns of s to every row matched by its
+// WHERE clause and returns how many rows were updated.
+func executeUpdate(table *Table, s Statement) (int, error) {
+	rows, err := table.selectRange(s.Where.Low, s.Where.High)
+	if err != nil {
+		return 0, err
+	}
+	if s.Set&ColumnID != 0 && len(rows) > 1 {
+		// every row would get the same key, fail before changing any
+		return 0, DBError{DuplicateKey}
+	}
+	for i, row := range rows {
+		key := row.ID
+		if s.Set&ColumnID != 0 {
+			row.ID = s.Row.ID
+		}
+		if s.Set&ColumnName != 0 {
+			row.Name = s.Row.Name
+		}
+		if s.Set&ColumnEmail != 0 {
+			row.Email = s.Row.Email
+		}
+		err = table.update(key, row)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(rows), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+// A database opened at MemoryDBPath lives in the cache of its pager alone:
+// pages are never evicted nor written, committing only forgets the images
+// the pages had as of the previous commit, which rolling back puts back. Its
+// file is an empty file of a private MemVFS, only there for the locks.
+
+// memoryState is what a pager keeps of the last commit of an in-memory
+// database.
+type memoryState struct {
+	// header is the header as of the last commit, pages the images of the
+	// pages modified since then.
+	header FileHeader
+	pages  map[int32]Page
+}
+
+// recordCommitted keeps the image of page before it is first modified after
+// the last commit. Pages created since then need no image, rolling back
+// drops them.
+func (pager *Pager) recordCommitted(page *Page) {
+	if pager.memory == nil || page.PageNum >= pager.dbSize {
+		return
+	}
+	if _, ok := pager.memory.pages[page.PageNum]; ok {
+		return
+	}
+	image := *page
+	image.dirty = false
+	image.pinCount = 0
+	pager.memory.pages[page.PageNum] = image
+}
+
+// commitMemory commits the changes made to an in-memory database.
+func (pager *Pager) commitMemory() {
+	pager.Header.PageCount = pager.PageNums
+	pager.Header.ChangeCounter++
+	for _, page := range pager.Cache.Pages() {
+		page.dirty = false
+	}
+	pager.dbSize = pager.PageNums
+	pager.memory.header = pager.Header
+	pager.memory.pages = make(map[int32]Page)
+}
+
+// rollbackMemory puts back the pages and the header of an in-memory database
+// as of the last commit.
+func (pager *Pager) rollbackMemory() {
+	for pageNum := pager.dbSize; pageNum < pager.PageNums; pageNum++ {
+		pager.Cache.Remove(pageNum)
+	}
+	for pageNum, image := range pager.memory.pages {
+		restored := image
+		if page := pager.Cache.Get(pageNum); page != nil {
+			restored.pinCount = page.pinCount
+			*page = restored
+			continue
+		}
+		pager.Cache.Put(&restored)
+	}
+	pager.Header = pager.memory.header
+	pager.PageNums = pager.dbSize
+	pager.memory.pages = make(map[int32]Page)
+}
@@ -0,0 +1,112 @@
+package main
+
+// A payload too large for its cell spills into a chain of overflow pages,
+// each holding the number of the next page of the chain, 0 for the last one,
+// and up to OverflowDataSize bytes of the payload.
+
+type OverflowHeader struct {
+	NextOverflow int32
+	DataSize     int32
+}
+
+type OverflowNode struct {
+	OverflowHeader
+	Data [OverflowDataSize]byte
+}
+
+// writeOverflow stores data in a new chain of overflow pages and returns
+// the number of its first page.
+func (pager *Pager) writeOverflow(data []byte) (int32, error) {
+	var first int32
+	var prev *Page
+	for len(data) > 0 {
+		page, err := pager.AllocatePage()
+		if err != nil {
+			pager.Unpin(prev)
+			return 0, err
+		}
+		page.reset(Overflow)
+		n := copy(page.Data[:], data)
+		page.DataSize = int32(n)
+		data = data[n:]
+		if prev == nil {
+			first = page.PageNum
+		} else {
+			prev.NextOverflow = page.PageNum
+			pager.Unpin(prev)
+		}
+		prev = page
+	}
+	pager.Unpin(prev)
+	return first, nil
+}
+
+// readOverflow reads size bytes from the chain of overflow pages starting at
+// pageNum. A chain that ends too soon, or points to a page that does not
+// exist, is reported as a Corrupt error of the page that points past it, one
+// without page number for the first page, which the cell points to.
+func readOverflow(pages pageReader, pageNum int32, size int32) ([]byte, error) {
+	data := make([]byte, 0, size)
+	prev := int32(0)
+	for int32(len(data)) < size {
+		if pageNum <= HeaderPageNum {
+			return nil, brokenChain(prev)
+		}
+		page, err := pages.GetPage(pageNum, false)
+		if err != nil {
+			return nil, err
+		}
+		if page == nil {
+			return nil, brokenChain(prev)
+		}
+		if page.NodeType != Overflow || page.DataSize > OverflowDataSize {
+			pages.Unpin(page)
+			return nil, corruptPage(pageNum)
+		}
+		data = append(data, page.Data[:page.DataSize]...)
+		prev = pageNum
+		pageNum = page.NextOverflow
+		pages.Unpin(page)
+	}
+	return data[:size], nil
+}
+
+// freeOverflow puts every page of the chain starting at pageNum on the
+// free-page list. A broken chain is reported as by readOverflow.
+func (pager *Pager) freeOverflow(pageNum int32) error {
+	prev := int32(0)
+	for pageNum != 0 {
+		if pageNum < HeaderPageNum {
+			return brokenChain(prev)
+		}
+		page, err := pager.GetPage(pageNum, false)
+		if err != nil {
+			return err
+		}
+		if page == nil {
+			return brokenChain(prev)
+		}
+		if page.NodeType != Overflow {
+			pager.Unpin(page)
+			return corruptPage(pageNum)
+		}
+		next := page.NextOverflow
+		err = pager.FreePage(page)
+		pager.Unpin(page)
+		if err != nil {
+			return err
+		}
+		prev = pageNum
+		pageNum = next
+	}
+	return nil
+}
+
+// brokenChain returns the Corrupt error of a chain whose page after prev is
+// missing, prev being 0 for the first page.
+func brokenChain(prev int32) error {
+	if prev == 0 {
+		return DBError{Corrupt}
+	}
+	return corruptPage(prev)
+}
@@ -17,21 +17,46 @@ const (
 
 const (
 	PageSize     = 1 << 12
-	RowSize = int32(unsafe.Sizeof(Row{}))
 	NodeTypeSize = int32(unsafe.Sizeof(Internal))
 	CommonNodeHeaderSize = int32(unsafe.Sizeof(CommonNodeHeader{}))
 	LeafNodeHeaderSize = int32(unsafe.Sizeof(LeafNodeHeader{}))
 	InternalNodeHeaderSize = int32(unsafe.Sizeof(InternalNodeHeader{}))
-	RowsPerPage  = (PageSize-CommonNodeHeaderSize-LeafNodeHeaderSize) / RowSize
+	LeafBodySize = PageSize - CommonNodeHeaderSize - LeafNodeHeaderSize - PageChecksumSize
 	ChildSize = int32(unsafe.Sizeof(Child{}))
-	ChildrenPerPage = (PageSize-CommonNodeHeaderSize-InternalNodeHeaderSize) / ChildSize
+	ChildrenPerPage = (PageSize-CommonNodeHeaderSize-InternalNodeHeaderSize-PageChecksumSize) / ChildSize
+	FreeTrunkHeaderSize = int32(unsafe.Sizeof(FreeTrunkHeader{}))
+	FreeLeavesPerTrunk = (PageSize - CommonNodeHeaderSize - FreeTrunkHeaderSize - PageChecksumSize) / 4
+	OverflowHeaderSize = int32(unsafe.Sizeof(OverflowHeader{}))
+	OverflowDataSize   = PageSize - CommonNodeHeaderSize - OverflowHeaderSize - PageChecksumSize
+	// MaxLocalPayload is the most payload bytes a cell keeps in its own page,
+	// the rest of a larger payload is stored in a chain of overflow pages.
+	MaxLocalPayload = PageSize / 16
+	// CellHeaderSize is the key and payload size at the start of a cell,
+	// MaxCellSize the size of a cell with an overflowing payload.
+	CellHeaderSize  = 6
+	CellPointerSize = 2
+	MaxCellSize     = CellHeaderSize + MaxLocalPayload + 4
+	// RowsPerPage is the number of rows a leaf holds whatever their size,
+	// short rows pack many more.
+	RowsPerPage = LeafBodySize / (MaxCellSize + CellPointerSize)
+	// MinLeafFill, in bytes, and MinChildrenPerPage are the fill below which
+	// a non-root page borrows from or is merged with a sibling. Two internal
+	// siblings that cannot lend always fit in a single page, two leaves that
+	// do not fit share their cells evenly instead.
+	MinLeafFill        = LeafBodySize / 3
+	MinChildrenPerPage = (ChildrenPerPage + 1) / 2
 )
 
 type Page struct {
 	CommonNodeHeader
 	LeafNode
 	InternalNode
-	// Rows [RowsPerPage]Row
+	FreeTrunkNode
+	OverflowNode
+
+	// dirty and pinCount are cache bookkeeping and never written to disk.
+	dirty    bool
+	pinCount int32
 }
 
 type NodeType uint8
@@ -39,6 +64,12 @@ type NodeType uint8
 const (
 	Internal NodeType = iota
 	Leaf
+	// Free pages are on the free-page list, only the trunk pages of the
+	// list use their content.
+	Free = NodeType(PageFree)
+	// Overflow pages hold the part of a cell payload that does not fit in
+	// the cell's page.
+	Overflow = NodeType(PageOverflow)
 )
 
 type CommonNodeHeader struct {
@@ -52,6 +83,13 @@ type CommonNodeHeader struct {
 type LeafNodeHeader struct {
 	NumCells int32
 	Sibling int32
+	// CellContent is the offset in Body of the first cell, 0 meaning the
+	// content area is empty.
+	CellContent int32
+	// FirstFreeBlock is the offset of the first free block, 0 if none.
+	FirstFreeBlock int32
+	// FragmentedBytes counts the holes too small to be a free block.
+	FragmentedBytes int32
 }
 
 type InternalNodeHeader struct {
@@ -67,7 +105,7 @@ type Child struct {
 
 type LeafNode struct {
 	LeafNodeHeader
-	Rows [RowsPerPage]Row
+	Body [LeafBodySize]byte
 }
 
 type InternalNode struct {
@@ -87,218 +125,564 @@ func (page *Page) ToBytes() ([]byte, error) {
 		err = binary.Write(buf, binary.BigEndian, page.InternalNode)
 	case Leaf:
 		err = binary.Write(buf, binary.BigEndian, page.LeafNode)
+	case Free:
+		err = binary.Write(buf, binary.BigEndian, page.FreeTrunkNode)
+	case Overflow:
+		err = binary.Write(buf, binary.BigEndian, page.OverflowNode)
 	}
 	if err != nil {
 		return nil, err
 	}
-	pageBytes := headerBuf.Bytes()
-	pageBytes = append(pageBytes, buf.Bytes()...)
-	if len(pageBytes) > PageSize {
+	if headerBuf.Len()+buf.Len() > PageSize-PageChecksumSize {
 		panic("page size > PageSize, seems like a bug")
 	}
+	pageBytes := make([]byte, PageSize)
+	n := copy(pageBytes, headerBuf.Bytes())
+	copy(pageBytes[n:], buf.Bytes())
+	setChecksum(page.PageNum, pageBytes)
 	return pageBytes, nil
 }
 
-func FromBytes(bs [PageSize]byte) Page {
-	nodeType := NodeType(bs[0]) // TODO: fix
+// FromBytes decodes a page written by ToBytes, it fails with a Corrupt error
+// if bs does not hold a page whose header is consistent with its content.
+// The checksum is not checked.
+func FromBytes(bs [PageSize]byte) (Page, error) {
 	var page Page
 	buf := bytes.NewBuffer(bs[:CommonNodeHeaderSize])
 	err := binary.Read(buf, binary.BigEndian, &page.CommonNodeHeader)
 	if err != nil {
-		panic(err)
+		return Page{}, DBError{Corrupt}
 	}
 	buf = bytes.NewBuffer(bs[CommonNodeHeaderSize:])
-	switch nodeType {
+	switch page.NodeType {
 	case Internal:
 		err = binary.Read(buf, binary.BigEndian, &page.InternalNode)
 	case Leaf:
 		err = binary.Read(buf, binary.BigEndian, &page.LeafNode)
+	case Free:
+		err = binary.Read(buf, binary.BigEndian, &page.FreeTrunkNode)
+	case Overflow:
+		err = binary.Read(buf, binary.BigEndian, &page.OverflowNode)
+	default:
+		err = DBError{Corrupt}
 	}
-	if err != nil {
-		panic(err)
+	if err != nil || !page.valid() {
+		return Page{}, DBError{Corrupt}
+	}
+	return page, nil
+}
+
+// valid reports whether the header of a decoded page fits its content, so
+// that using the page cannot index past it.
+func (page *Page) valid() bool {
+	switch page.NodeType {
+	case Internal:
+		if page.ChildrenNum < 0 || page.ChildrenNum > ChildrenPerPage {
+			return false
+		}
+	case Leaf:
+		if !page.validLeaf() {
+			return false
+		}
+	case Free:
+		if page.LeafCount < 0 || page.LeafCount > FreeLeavesPerTrunk {
+			return false
+		}
+	case Overflow:
+		if page.DataSize < 0 || page.DataSize > OverflowDataSize {
+			return false
+		}
+	}
+	for _, pageNum := range page.references() {
+		if pageNum <= HeaderPageNum {
+			return false
+		}
+	}
+	return true
+}
+
+// references returns the numbers of the pages page points to.
+func (page *Page) references() []int32 {
+	var refs []int32
+	switch page.NodeType {
+	case Internal:
+		for _, child := range page.Children[:page.ChildrenNum] {
+			refs = append(refs, child.PageNum)
+		}
+		refs = append(refs, page.RightmostChild)
+	case Leaf:
+		if page.Sibling != 0 {
+			refs = append(refs, page.Sibling)
+		}
+	case Free:
+		if page.NextTrunk != 0 {
+			refs = append(refs, page.NextTrunk)
+		}
+		refs = append(refs, page.Leaves[:page.LeafCount]...)
+	case Overflow:
+		if page.NextOverflow != 0 {
+			refs = append(refs, page.NextOverflow)
+		}
 	}
-	return page
+	return refs
 }
 
 func (page *Page) Insert(row Row, cursor *Cursor) error {
 	if page.NodeType != Leaf {
 		panic("page should be leaf node")
 	}
-	if page.NumCells >= RowsPerPage {
-		return page.SplitAndInsert(row, cursor)
+	cell, err := cursor.Table.Pager.NewCell(row)
+	if err != nil {
+		return err
 	}
+	raw := cell.encode()
 
-	for i:=page.NumCells; i>cursor.CellNum; i-- {
-		page.Rows[i] = page.Rows[i-1]
+	// the search only leads a key to a child whose key is not smaller than
+	// it, so the parent's key of this page stays a valid upper bound
+	cursor.Table.Pager.MarkDirty(page)
+	if page.insertCell(cursor.CellNum, raw) {
+		return nil
 	}
-	page.Rows[cursor.CellNum] = row
-	if cursor.CellNum == page.NumCells && !page.RootNode {
-		var oldMax int32
-		if page.NumCells > 0 {
-			oldMax = page.Rows[page.NumCells-1].ID
-		}
-		parent, err := cursor.Table.Pager.GetPage(page.ParentNode, false)
+	return page.SplitAndInsert(raw, cursor)
+}
+
+// Replace overwrites the row at cursor with row, which has the same key.
+func (page *Page) Replace(row Row, cursor *Cursor) error {
+	pager := cursor.Table.Pager
+	pager.MarkDirty(page)
+	err := pager.FreeCell(page.LeafCell(cursor.CellNum))
+	if err != nil {
+		return onPage(err, page.PageNum)
+	}
+	page.removeCell(cursor.CellNum)
+	return page.Insert(row, cursor)
+}
+
+func (page *Page) SplitAndInsert(raw []byte, cursor *Cursor) error {
+	table := cursor.Table
+	newPage, err := table.Pager.AllocatePage()
+	if err != nil {
+		return err
+	}
+	defer table.Pager.Unpin(newPage)
+	newPageIdx := newPage.PageNum
+	table.Pager.MarkDirty(page)
+	// share the cells with the new cell between the two pages, the left
+	// page keeping the first half of the bytes
+	cells := page.leafCells()
+	cells = append(cells, nil)
+	copy(cells[cursor.CellNum+1:], cells[cursor.CellNum:])
+	cells[cursor.CellNum] = raw
+	leftCount := splitCells(cells)
+	page.setLeafCells(cells[:leftCount])
+	newPage.setLeafCells(cells[leftCount:])
+	newPage.Sibling = page.Sibling
+	page.Sibling = newPageIdx
+	leftMax := page.CellKey(page.NumCells - 1)
+	if page.RootNode {
+		return CreateNewRoot(table, leftMax, newPageIdx)
+	}
+	newPage.ParentNode = page.ParentNode
+	parent, err := table.Pager.GetPage(page.ParentNode, false)
+	if err != nil {
+		return err
+	}
+	defer table.Pager.Unpin(parent)
+	return parent.InternalNodeInsert(table, page.PageNum, leftMax, newPageIdx)
+}
+
+// InternalNodeInsert records in page that its child leftPageNum has been
+// split into leftPageNum, holding keys up to leftMax, and rightPageNum,
+// holding the keys above it. page is split in turn when it has no room
+// for another child.
+func (page *Page) InternalNodeInsert(table *Table, leftPageNum int32, leftMax int32, rightPageNum int32) error {
+	children := page.childList()
+	idx := page.InternalNodeFindChild(leftMax)
+	if children[idx].PageNum != leftPageNum {
+		// the split child is not where its keys lead
+		return corruptPage(page.PageNum)
+	}
+	table.Pager.MarkDirty(page)
+	children = append(children, Child{})
+	copy(children[idx+2:], children[idx+1:])
+	children[idx+1] = Child{
+		Key:     children[idx].Key,
+		PageNum: rightPageNum,
+	}
+	children[idx].Key = leftMax
+	if int32(len(children))-1 <= ChildrenPerPage {
+		page.setChildList(children)
+		return nil
+	}
+	return page.InternalNodeSplit(table, children)
+}
+
+// InternalNodeSplit moves the right half of children to a new internal
+// page, keeps the left half in page and promotes the key of the last left
+// child as the separator of the two pages in their parent.
+func (page *Page) InternalNodeSplit(table *Table, children []Child) error {
+	newPage, err := table.Pager.AllocatePage()
+	if err != nil {
+		return err
+	}
+	defer table.Pager.Unpin(newPage)
+	newPageIdx := newPage.PageNum
+	leftCount := len(children) / 2
+	leftChildren, rightChildren := children[:leftCount], children[leftCount:]
+	leftMax := leftChildren[leftCount-1].Key
+
+	newPage.NodeType = Internal
+	newPage.ParentNode = page.ParentNode
+	newPage.setChildList(rightChildren)
+	err = table.setParent(rightChildren, newPageIdx)
+	if err != nil {
+		return err
+	}
+	page.setChildList(leftChildren)
+	if page.RootNode {
+		return CreateNewRoot(table, leftMax, newPageIdx)
+	}
+	parent, err := table.Pager.GetPage(page.ParentNode, false)
+	if err != nil {
+		return err
+	}
+	defer table.Pager.Unpin(parent)
+	return parent.InternalNodeInsert(table, page.PageNum, leftMax, newPageIdx)
+}
+
+// CreateNewRoot moves the content of the root, the left half of a split,
+// to a new page and turns the root into an internal node whose children are
+// that page and rightChildIdx, the right half.
+func CreateNewRoot(table *Table, leftMax int32, rightChildIdx int32) error {
+	leftChild, err := table.Pager.AllocatePage()
+	if err != nil {
+		return err
+	}
+	defer table.Pager.Unpin(leftChild)
+	leftChildIdx := leftChild.PageNum
+	// copy root to left child
+	rootPage, err := table.Pager.GetPage(table.RootPageNum, false)
+	if err != nil {
+		return err
+	}
+	defer table.Pager.Unpin(rootPage)
+	rightChild, err := table.Pager.GetPage(rightChildIdx, false)
+	if err != nil {
+		return err
+	}
+	defer table.Pager.Unpin(rightChild)
+	table.Pager.MarkDirty(rootPage)
+	table.Pager.MarkDirty(rightChild)
+	leftChild.NodeType = rootPage.NodeType
+	leftChild.LeafNode = rootPage.LeafNode
+	leftChild.InternalNode = rootPage.InternalNode
+	leftChild.RootNode = false
+	leftChild.ParentNode = table.RootPageNum
+	rightChild.ParentNode = table.RootPageNum
+	if leftChild.NodeType == Internal {
+		err = table.setParent(leftChild.childList(), leftChildIdx)
 		if err != nil {
 			return err
 		}
-		idx := parent.InternalNodeFindChild(oldMax)
-		parent.Children[idx].Key = row.ID
 	}
-	page.NumCells++
+	rootPage.LeafNode = LeafNode{}
+	rootPage.InternalNode = InternalNode{}
+	rootPage.NodeType = Internal
+	rootPage.setChildList([]Child{{Key: leftMax, PageNum: leftChildIdx}, {PageNum: rightChildIdx}})
 	return nil
 }
 
-func (page *Page) SplitAndInsert(row Row, cursor *Cursor) error {
+// Delete removes the row at cursor from the leaf page, with its overflow
+// pages, and rebalances the tree if the page is left less than MinLeafFill
+// full.
+func (page *Page) Delete(cursor *Cursor) error {
+	if page.NodeType != Leaf {
+		panic("page should be leaf node")
+	}
 	table := cursor.Table
-	newPageIdx := table.Pager.GetNewPageNum()
-	newPage, err := table.Pager.GetPage(newPageIdx, true)
+	table.Pager.MarkDirty(page)
+	cell := page.LeafCell(cursor.CellNum)
+	err := table.Pager.FreeCell(cell)
+	if err != nil {
+		return onPage(err, page.PageNum)
+	}
+	key := cell.Key
+	page.removeCell(cursor.CellNum)
+	if page.RootNode || page.usedSize() >= MinLeafFill {
+		return nil
+	}
+	return page.Rebalance(table, key)
+}
+
+// Rebalance fixes an underflowing non-root page, key being any key whose
+// search leads to it. An internal page borrows a child from an adjacent
+// sibling that can spare one, a leaf shares its cells evenly with a sibling
+// when the two do not fit in one page. Otherwise the two are merged and the
+// parent, which loses a child, is rebalanced in turn. A root left with a single child is
+// replaced by that child.
+func (page *Page) Rebalance(table *Table, key int32) error {
+	pager := table.Pager
+	parent, err := pager.GetPage(page.ParentNode, false)
 	if err != nil {
 		return err
 	}
-	// move right half rows from old page to new page
-	halfPageCount := (RowsPerPage+1)/2
-	oldLeftMax := page.Rows[page.NumCells-1].ID
-	for i:=RowsPerPage; i>=0; i-- {
-		var target *Page
-		if i >= halfPageCount {
-			target = newPage
-		} else {
-			target = page
-		}
+	defer pager.Unpin(parent)
+	children := parent.childList()
+	idx := parent.InternalNodeFindChild(key)
+	if children[idx].PageNum != page.PageNum {
+		// the underflowing child is not where its keys lead
+		return corruptPage(parent.PageNum)
+	}
+	// rebalance with the left sibling, or the right one for the first child
+	leftIdx := idx - 1
+	if idx == 0 {
+		leftIdx = 0
+	}
+	var left, right *Page
+	if leftIdx == idx {
+		left = page
+		right, err = pager.GetPage(children[leftIdx+1].PageNum, false)
+	} else {
+		right = page
+		left, err = pager.GetPage(children[leftIdx].PageNum, false)
+	}
+	if err != nil {
+		return err
+	}
+	sibling := left
+	if left == page {
+		sibling = right
+	}
+	defer pager.Unpin(sibling)
+	pager.MarkDirty(parent)
+	pager.MarkDirty(sibling)
+	separator := children[leftIdx].Key
 
-		if i == cursor.CellNum {
-			target.Rows[i%halfPageCount] = row
-		} else if i > cursor.CellNum {
-			target.Rows[i%halfPageCount] = page.Rows[i-1]
-		} else {
-			target.Rows[i%halfPageCount] = page.Rows[i]
-		}
+	if page.NodeType == Leaf && left.usedSize()+right.usedSize() > LeafBodySize {
+		children[leftIdx].Key = leafNodeRedistribute(left, right)
+		parent.setChildList(children)
+		return nil
 	}
-	newPage.NumCells = halfPageCount
-	page.NumCells = halfPageCount
-	if page.RootNode {
-		err = CreateNewRoot(table, newPageIdx)
+	if page.NodeType == Internal && sibling.entryCount() > MinChildrenPerPage {
+		children[leftIdx].Key, err = internalNodeBorrow(table, left, right, separator, page == left)
 		if err != nil {
 			return err
 		}
-		newPage.ParentNode = table.RootPageNum
-		newPage.Sibling = 0 // End
+		parent.setChildList(children)
+		return nil
+	}
+
+	if page.NodeType == Leaf {
+		left.setLeafCells(append(left.leafCells(), right.leafCells()...))
+		left.Sibling = right.Sibling
 	} else {
-		parent, err := table.Pager.GetPage(page.ParentNode, false)
+		leftChildren := left.childList()
+		leftChildren[len(leftChildren)-1].Key = separator
+		rightChildren := right.childList()
+		err = table.setParent(rightChildren, left.PageNum)
 		if err != nil {
 			return err
 		}
-		newLeftMax := page.Rows[page.NumCells-1].ID
-		if parent.ChildrenNum >= ChildrenPerPage {
-			panic("need to implement internal node split")
-		}
-		if page.Sibling == 0 { // page is the rightmost page
-			parent.Children[parent.ChildrenNum] = Child{
-				Key:     newLeftMax,
-				PageNum: page.PageNum,
-			}
-			parent.ChildrenNum++
-			parent.RightmostChild = newPageIdx
-		} else {
-			childIdx := parent.InternalNodeFindChild(oldLeftMax)
-			parent.Children[childIdx].Key = newLeftMax
-			// insert new page
-			for i:=parent.ChildrenNum; i>childIdx+1; i-- {
-				parent.Children[i] = parent.Children[i-1]
-			}
-			parent.Children[childIdx+1].Key = newPage.Rows[newPage.NumCells-1].ID
-			parent.Children[childIdx+1].PageNum = newPageIdx
+		left.setChildList(append(leftChildren, rightChildren...))
+	}
+	// left takes over the slot of right, whose key bounds both of them
+	children[leftIdx+1].PageNum = left.PageNum
+	children = append(children[:leftIdx], children[leftIdx+1:]...)
+	parent.setChildList(children)
+	err = pager.FreePage(right)
+	if err != nil {
+		return err
+	}
 
-			parent.ChildrenNum++
+	if parent.RootNode {
+		if parent.ChildrenNum == 0 {
+			return CollapseRoot(table)
 		}
-		page.Sibling = newPageIdx
+		return nil
+	}
+	if parent.entryCount() < MinChildrenPerPage {
+		return parent.Rebalance(table, key)
 	}
 	return nil
 }
 
-func CreateNewRoot(table *Table, rightChildIdx int32) error {
-	leftChildIdx := table.Pager.GetNewPageNum()
-	leftChild, err := table.Pager.GetPage(leftChildIdx, true)
+// leafNodeRedistribute shares the cells of two adjacent leaves evenly between
+// them and returns the new max key of left.
+func leafNodeRedistribute(left *Page, right *Page) int32 {
+	cells := append(left.leafCells(), right.leafCells()...)
+	leftCount := splitCells(cells)
+	left.setLeafCells(cells[:leftCount])
+	right.setLeafCells(cells[leftCount:])
+	return left.CellKey(left.NumCells - 1)
+}
+
+// internalNodeBorrow moves one child between two adjacent internal pages,
+// separated by separator in their parent, into left if toLeft is set and
+// into right otherwise, and returns the new separator.
+func internalNodeBorrow(table *Table, left *Page, right *Page, separator int32, toLeft bool) (int32, error) {
+	leftChildren := left.childList()
+	leftChildren[len(leftChildren)-1].Key = separator
+	rightChildren := right.childList()
+	var moved Child
+	var target *Page
+	if toLeft {
+		moved, target = rightChildren[0], left
+		leftChildren = append(leftChildren, moved)
+		rightChildren = rightChildren[1:]
+	} else {
+		moved, target = leftChildren[len(leftChildren)-1], right
+		leftChildren = leftChildren[:len(leftChildren)-1]
+		rightChildren = append([]Child{moved}, rightChildren...)
+	}
+	err := table.setParent([]Child{moved}, target.PageNum)
+	if err != nil {
+		return 0, err
+	}
+	newSeparator := leftChildren[len(leftChildren)-1].Key
+	left.setChildList(leftChildren)
+	right.setChildList(rightChildren)
+	return newSeparator, nil
+}
+
+// CollapseRoot replaces an internal root left with a single child by the
+// content of that child, making the tree one level shorter.
+func CollapseRoot(table *Table) error {
+	pager := table.Pager
+	root, err := pager.GetPage(table.RootPageNum, false)
 	if err != nil {
 		return err
 	}
-	// copy root to left child
-	rootPage, err := table.Pager.GetPage(table.RootPageNum, false)
+	defer pager.Unpin(root)
+	child, err := pager.GetPage(root.RightmostChild, false)
 	if err != nil {
 		return err
 	}
-	leftChild.LeafNode = rootPage.LeafNode
-	leftChild.RootNode = false
-	leftChild.NodeType = Leaf
-	leftChild.ParentNode = table.RootPageNum
-	rootPage.LeafNode = LeafNode{}
-	rootPage.ChildrenNum = 1
-	rootPage.NodeType = Internal
-	rootPage.Children[0].PageNum = leftChildIdx
-	rootPage.Children[0].Key = leftChild.Rows[leftChild.NumCells-1].ID
-	rootPage.RightmostChild = rightChildIdx
-	leftChild.Sibling = rightChildIdx
+	defer pager.Unpin(child)
+	pager.MarkDirty(root)
+	root.NodeType = child.NodeType
+	root.LeafNode = child.LeafNode
+	root.InternalNode = child.InternalNode
+	if root.NodeType == Internal {
+		err = table.setParent(root.childList(), root.PageNum)
+		if err != nil {
+			return err
+		}
+	}
+	return pager.FreePage(child)
+}
+
+// entryCount is the number of rows of a leaf or of children of an internal
+// page.
+func (page *Page) entryCount() int32 {
+	if page.NodeType == Leaf {
+		return page.NumCells
+	}
+	return page.ChildrenNum + 1
+}
+
+// childList returns the keyed children of an internal page followed by its
+// rightmost child, whose key is meaningless.
+func (page *Page) childList() []Child {
+	children := make([]Child, page.ChildrenNum+1, page.ChildrenNum+2)
+	copy(children, page.Children[:page.ChildrenNum])
+	children[page.ChildrenNum] = Child{PageNum: page.RightmostChild}
+	return children
+}
+
+// setChildList is the reverse of childList.
+func (page *Page) setChildList(children []Child) {
+	last := int32(len(children) - 1)
+	copy(page.Children[:], children[:last])
+	for i := last; i < ChildrenPerPage; i++ {
+		page.Children[i] = Child{}
+	}
+	page.ChildrenNum = last
+	page.RightmostChild = children[last].PageNum
+}
+
+// setParent points the ParentNode of every page in children to parent.
+func (table *Table) setParent(children []Child, parent int32) error {
+	for _, child := range children {
+		page, err := table.Pager.GetPage(child.PageNum, false)
+		if err != nil {
+			return err
+		}
+		table.Pager.MarkDirty(page)
+		page.ParentNode = parent
+		table.Pager.Unpin(page)
+	}
 	return nil
 }
 
+// LeafNodeSearch descends from page to the leaf that holds key, or where key
+// would be inserted, and returns a cursor at that cell. It is the one
+// descent used by insert, lookup and range scans, and walks down
+// iteratively so the tree height is not limited by the stack.
 func (page *Page) LeafNodeSearch(table *Table, key int32) (Cursor, error) {
-	cursor := Cursor{
-		Table:      table,
-		PageNum:    page.PageNum,
-		CellNum:    0,
-		EndOfTable: false,
-	}
-	switch page.NodeType {
-	case Leaf:
-		left := int32(0)
-		right := page.NumCells
-		mid := left + (right-left)/2
-		for left < right {
-			midRow := page.Rows[mid]
-			if midRow.ID == key {
-				break
-			} else if midRow.ID < key {
-				left = mid+1
-			} else {
-				right = mid
+	pages := table.pages()
+	node := page
+	for node.NodeType == Internal {
+		if node.ChildrenNum == 0 {
+			// empty children cannot be internal
+			if node != page {
+				pages.Unpin(node)
 			}
-			mid = left + (right-left)/2
+			return Cursor{}, corruptPage(node.PageNum)
 		}
-		cursor.CellNum = left
-	case Internal:
-		if page.ChildrenNum == 0 {
-			panic("empty children cannot be internal")
+		childIdx := node.InternalNodeFindChild(key)
+		childPageNum := node.RightmostChild
+		if childIdx < node.ChildrenNum {
+			childPageNum = node.Children[childIdx].PageNum
 		}
-		var left int32
-		if key > page.Children[page.ChildrenNum-1].Key {
-			left = page.RightmostChild
-		} else {
-			left = int32(0)
-			right := page.ChildrenNum
-			mid := left + (right-left)/2
-			for left < right {
-				midKey := page.Children[mid]
-				if midKey.Key == key {
-					break
-				} else if midKey.Key < key {
-					left = mid + 1
-				} else {
-					right = mid
-				}
-				mid = left + (right-left)/2
-			}
+		child, err := pages.GetPage(childPageNum, false)
+		if node != page {
+			pages.Unpin(node)
 		}
-		cursor.PageNum = page.Children[left].PageNum
-		newPage, err := table.Pager.GetPage(left, false)
 		if err != nil {
-			return cursor, err
+			return Cursor{}, err
 		}
-		return newPage.LeafNodeSearch(table, key)
+		node = child
+	}
+	if node.NodeType != Leaf {
+		if node != page {
+			pages.Unpin(node)
+		}
+		return Cursor{}, corruptPage(node.PageNum)
+	}
+	cursor := Cursor{
+		Table:      table,
+		PageNum:    node.PageNum,
+		CellNum:    node.LeafNodeFindCell(key),
+		EndOfTable: false,
+	}
+	if node != page {
+		pages.Unpin(node)
 	}
-
 	return cursor, nil
 }
 
+// LeafNodeFindCell returns the index of key in a leaf page, or of the first
+// row with a bigger key if it is not there.
+func (page *Page) LeafNodeFindCell(key int32) int32 {
+	left := int32(0)
+	right := page.NumCells
+	mid := left + (right-left)/2
+	for left < right {
+		midKey := page.CellKey(mid)
+		if midKey == key {
+			break
+		} else if midKey < key {
+			left = mid+1
+		} else {
+			right = mid
+		}
+		mid = left + (right-left)/2
+	}
+	return mid
+}
+
+// InternalNodeFindChild returns the index of the first child whose key is not
+// smaller than key, ChildrenNum meaning the rightmost child.
 func (page *Page) InternalNodeFindChild(key int32) int32 {
 	left := int32(0)
 	right := page.ChildrenNum
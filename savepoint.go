@@ -0,0 +1,243 @@
+package main
+
+import "strings"
+
+// A savepoint marks a point of the current transaction that can be rolled
+// back to without discarding the whole transaction. Savepoints nest: each one
+// keeps the image, as of its creation, of the pages modified after it and
+// before the next one, so rolling back to a savepoint writes back the images
+// of the savepoints above it, then its own, newest first.
+
+type savepoint struct {
+	name string
+	// header and pageNums are those of the pager when the savepoint was
+	// created, pages the images of the pages modified since then.
+	header   FileHeader
+	pageNums int32
+	pages    map[int32][]byte
+	// err is why the image of a page could not be kept, the savepoint can
+	// then be neither rolled back to nor released into the transaction.
+	err error
+}
+
+// Savepoint starts a savepoint of the transaction named name, names can be
+// reused, the latest one hiding the others.
+func (tx *Tx) Savepoint(name string) error {
+	tx.table.lock()
+	defer tx.table.unlock()
+	return tx.savepoint(name)
+}
+
+func (tx *Tx) savepoint(name string) error {
+	if tx.table.tx != tx {
+		return DBError{NoTransaction}
+	}
+	tx.table.Pager.Savepoint(name)
+	return nil
+}
+
+// Release forgets the latest savepoint named name and those started after it,
+// keeping their changes. Releasing the outermost savepoint of a transaction
+// started by Table.Savepoint commits it.
+func (tx *Tx) Release(name string) error {
+	tx.table.lock()
+	defer tx.table.unlock()
+	return tx.release(name)
+}
+
+func (tx *Tx) release(name string) error {
+	if tx.table.tx != tx {
+		return DBError{NoTransaction}
+	}
+	pager := tx.table.Pager
+	err := pager.ReleaseSavepoint(name)
+	if err != nil {
+		return err
+	}
+	if tx.implicit && len(pager.savepoints) == 0 {
+		return tx.commit()
+	}
+	return nil
+}
+
+// RollbackTo discards the changes made since the latest savepoint named name,
+// which stays active, and forgets the savepoints started after it.
+func (tx *Tx) RollbackTo(name string) error {
+	tx.table.lock()
+	defer tx.table.unlock()
+	return tx.rollbackTo(name)
+}
+
+func (tx *Tx) rollbackTo(name string) error {
+	if tx.table.tx != tx {
+		return DBError{NoTransaction}
+	}
+	return tx.table.Pager.RollbackToSavepoint(name)
+}
+
+// Savepoint starts a savepoint named name, in a new transaction if none is
+// active.
+func (table *Table) Savepoint(name string) error {
+	table.lock()
+	defer table.unlock()
+	return table.savepoint(name)
+}
+
+func (table *Table) savepoint(name string) error {
+	if table.tx == nil {
+		tx, err := table.begin()
+		if err != nil {
+			return err
+		}
+		tx.implicit = true
+	}
+	return table.tx.savepoint(name)
+}
+
+// Savepoint pushes a new savepoint named name.
+func (pager *Pager) Savepoint(name string) {
+	pager.savepoints = append(pager.savepoints, &savepoint{
+		name:     name,
+		header:   pager.Header,
+		pageNums: pager.PageNums,
+		pages:    make(map[int32][]byte),
+	})
+}
+
+// findSavepoint returns the position of the latest savepoint named name, or
+// -1. Names are case insensitive, as in SQL.
+func (pager *Pager) findSavepoint(name string) int {
+	for i := len(pager.savepoints) - 1; i >= 0; i-- {
+		if strings.EqualFold(pager.savepoints[i].name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ReleaseSavepoint pops the latest savepoint named name and those above it.
+// The page images they hold move to the savepoint below, unless it already
+// has an older image of the same page.
+func (pager *Pager) ReleaseSavepoint(name string) error {
+	i := pager.findSavepoint(name)
+	if i < 0 {
+		return DBError{NoSuchSavepoint}
+	}
+	err := pager.savepointError(i)
+	if i == 0 && err != nil {
+		return err
+	}
+	if i > 0 {
+		below := pager.savepoints[i-1]
+		if below.err == nil {
+			below.err = err
+		}
+		for _, sp := range pager.savepoints[i:] {
+			for pageNum, image := range sp.pages {
+				if _, ok := below.pages[pageNum]; !ok && pageNum < below.pageNums {
+					below.pages[pageNum] = image
+				}
+			}
+		}
+	}
+	pager.savepoints = pager.savepoints[:i]
+	return nil
+}
+
+// RollbackToSavepoint restores the pages and the header as they were when
+// the latest savepoint named name was created. The savepoints above it are
+// popped, it stays on the stack with no page image.
+func (pager *Pager) RollbackToSavepoint(name string) error {
+	i := pager.findSavepoint(name)
+	if i < 0 {
+		return DBError{NoSuchSavepoint}
+	}
+	err := pager.savepointError(i)
+	if err != nil {
+		return err
+	}
+	target := pager.savepoints[i]
+	for j := len(pager.savepoints) - 1; j >= i; j-- {
+		for pageNum, image := range pager.savepoints[j].pages {
+			if pageNum >= target.pageNums {
+				continue
+			}
+			err := pager.preservePage(pageNum)
+			if err == nil {
+				err = pager.restorePage(pageNum, image)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for pageNum := target.pageNums; pageNum < pager.PageNums; pageNum++ {
+		err := pager.preservePage(pageNum)
+		if err != nil {
+			return err
+		}
+		pager.Cache.Remove(pageNum)
+	}
+	pager.PageNums = target.pageNums
+	pager.Header = target.header
+	target.pages = make(map[int32][]byte)
+	pager.savepoints = pager.savepoints[:i+1]
+	return nil
+}
+
+// restorePage puts image back as the content of page pageNum, dirty.
+func (pager *Pager) restorePage(pageNum int32, image []byte) error {
+	var bs [PageSize]byte
+	copy(bs[:], image)
+	restored, err := pager.decodePage(pageNum, bs)
+	if err != nil {
+		return err
+	}
+	restored.dirty = true
+	if page := pager.Cache.Get(pageNum); page != nil {
+		restored.pinCount = page.pinCount
+		*page = restored
+		return nil
+	}
+	err = pager.SetPage(pageNum, &restored)
+	if err != nil {
+		return err
+	}
+	pager.Unpin(&restored)
+	return nil
+}
+
+// recordPage keeps the image of page in the innermost savepoint before the
+// page is first modified after it. Pages created after the savepoint need no
+// image, rolling back drops them.
+func (pager *Pager) recordPage(page *Page) {
+	if len(pager.savepoints) == 0 {
+		return
+	}
+	sp := pager.savepoints[len(pager.savepoints)-1]
+	if page.PageNum >= sp.pageNums {
+		return
+	}
+	if _, ok := sp.pages[page.PageNum]; ok {
+		return
+	}
+	bs, err := page.ToBytes()
+	if err != nil {
+		if sp.err == nil {
+			sp.err = err
+		}
+		return
+	}
+	sp.pages[page.PageNum] = bs
+}
+
+// savepointError returns the first failure to keep a page image of the
+// savepoint at position i or of those above it.
+func (pager *Pager) savepointError(i int) error {
+	for _, sp := range pager.savepoints[i:] {
+		if sp.err != nil {
+			return sp.err
+		}
+	}
+	return nil
+}
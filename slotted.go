@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Leaf pages are slotted: Body starts with the 2-byte offsets of the cells in
+// key order, growing towards the end of the page, while the cells are
+// allocated from the end of Body towards its start. Space freed between cells
+// is kept on a list of free blocks sorted by offset, each block starting with
+// the offset of the next one and its own size. Holes too small to hold a free
+// block are only counted in FragmentedBytes, until the page is defragmented.
+
+const freeBlockMinSize = 4
+
+// validLeaf reports whether the cell pointers, the cells and the free blocks
+// of a decoded leaf all lie within Body.
+func (page *Page) validLeaf() bool {
+	if page.NumCells < 0 || page.CellContent < 0 || page.CellContent > LeafBodySize ||
+		page.FragmentedBytes < 0 || page.FragmentedBytes > LeafBodySize {
+		return false
+	}
+	start := page.contentStart()
+	if page.NumCells > start/CellPointerSize {
+		return false
+	}
+	for i := int32(0); i < page.NumCells; i++ {
+		offset := page.cellOffset(i)
+		if offset < start || offset+CellHeaderSize > LeafBodySize ||
+			offset+cellSize(page.Body[offset:]) > LeafBodySize {
+			return false
+		}
+	}
+	for offset := page.FirstFreeBlock; offset != 0; {
+		if offset < start || offset+freeBlockMinSize > LeafBodySize {
+			return false
+		}
+		next, size := page.freeBlock(offset)
+		if size < freeBlockMinSize || offset+size > LeafBodySize || next != 0 && next <= offset {
+			return false
+		}
+		offset = next
+	}
+	return true
+}
+
+// contentStart returns the offset of the cell content area.
+func (page *Page) contentStart() int32 {
+	if page.CellContent == 0 {
+		return LeafBodySize
+	}
+	return page.CellContent
+}
+
+func (page *Page) cellOffset(cellNum int32) int32 {
+	return int32(binary.BigEndian.Uint16(page.Body[cellNum*CellPointerSize:]))
+}
+
+func (page *Page) setCellOffset(cellNum int32, offset int32) {
+	binary.BigEndian.PutUint16(page.Body[cellNum*CellPointerSize:], uint16(offset))
+}
+
+// cellBytes returns the encoded cell cellNum, it shares the memory of the
+// page.
+func (page *Page) cellBytes(cellNum int32) []byte {
+	offset := page.cellOffset(cellNum)
+	return page.Body[offset : offset+cellSize(page.Body[offset:])]
+}
+
+// CellKey returns the key of cell cellNum of a leaf page.
+func (page *Page) CellKey(cellNum int32) int32 {
+	return int32(binary.BigEndian.Uint32(page.Body[page.cellOffset(cellNum):]))
+}
+
+// LeafCell returns cell cellNum of a leaf page.
+func (page *Page) LeafCell(cellNum int32) Cell {
+	return decodeCell(page.cellBytes(cellNum))
+}
+
+func (page *Page) freeBlock(offset int32) (next int32, size int32) {
+	return int32(binary.BigEndian.Uint16(page.Body[offset:])), int32(binary.BigEndian.Uint16(page.Body[offset+2:]))
+}
+
+func (page *Page) setFreeBlock(offset int32, next int32, size int32) {
+	binary.BigEndian.PutUint16(page.Body[offset:], uint16(next))
+	binary.BigEndian.PutUint16(page.Body[offset+2:], uint16(size))
+}
+
+// freeSpace returns the number of bytes a leaf can still use, fragmented or
+// not.
+func (page *Page) freeSpace() int32 {
+	free := page.contentStart() - page.NumCells*CellPointerSize + page.FragmentedBytes
+	for offset := page.FirstFreeBlock; offset != 0; {
+		next, size := page.freeBlock(offset)
+		free += size
+		offset = next
+	}
+	return free
+}
+
+// usedSize returns the number of bytes taken by the cells of a leaf and their
+// pointers.
+func (page *Page) usedSize() int32 {
+	return LeafBodySize - page.freeSpace()
+}
+
+// allocate reserves size bytes for a cell, from the first free block large
+// enough or else from the start of the content area. It assumes there is room
+// for the cell and its pointer, defragmenting the page if the room is
+// scattered.
+func (page *Page) allocate(size int32) int32 {
+	prev := int32(0)
+	for offset := page.FirstFreeBlock; offset != 0; {
+		next, blockSize := page.freeBlock(offset)
+		if blockSize >= size {
+			left := blockSize - size
+			if left >= freeBlockMinSize {
+				page.setFreeBlock(offset, next, left)
+				return offset + left
+			}
+			if prev == 0 {
+				page.FirstFreeBlock = next
+			} else {
+				page.setFreeBlock(prev, next, page.freeBlockSize(prev))
+			}
+			page.FragmentedBytes += left
+			return offset
+		}
+		prev = offset
+		offset = next
+	}
+	if page.contentStart()-page.NumCells*CellPointerSize < size+CellPointerSize {
+		page.defragment()
+	}
+	page.CellContent = page.contentStart() - size
+	return page.CellContent
+}
+
+func (page *Page) freeBlockSize(offset int32) int32 {
+	_, size := page.freeBlock(offset)
+	return size
+}
+
+// release gives back the size bytes at offset, merging them with the
+// adjacent free blocks, or with the gap before the content area.
+func (page *Page) release(offset int32, size int32) {
+	blocks := [][2]int32{{offset, size}}
+	for block := page.FirstFreeBlock; block != 0; {
+		next, blockSize := page.freeBlock(block)
+		blocks = append(blocks, [2]int32{block, blockSize})
+		block = next
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i][0] < blocks[j][0]
+	})
+	merged := blocks[:1]
+	for _, block := range blocks[1:] {
+		last := &merged[len(merged)-1]
+		if last[0]+last[1] == block[0] {
+			last[1] += block[1]
+		} else {
+			merged = append(merged, block)
+		}
+	}
+	if merged[0][0] == page.contentStart() {
+		page.CellContent = merged[0][0] + merged[0][1]
+		if page.CellContent == LeafBodySize {
+			page.CellContent = 0
+		}
+		merged = merged[1:]
+	}
+	page.FirstFreeBlock = 0
+	for i := len(merged) - 1; i >= 0; i-- {
+		page.setFreeBlock(merged[i][0], page.FirstFreeBlock, merged[i][1])
+		page.FirstFreeBlock = merged[i][0]
+	}
+}
+
+// insertCell inserts the encoded cell raw at position cellNum of a leaf page,
+// it returns false if the page has no room for it.
+func (page *Page) insertCell(cellNum int32, raw []byte) bool {
+	size := int32(len(raw))
+	if page.freeSpace() < size+CellPointerSize {
+		return false
+	}
+	if page.contentStart()-page.NumCells*CellPointerSize < CellPointerSize {
+		page.defragment()
+	}
+	offset := page.allocate(size)
+	copy(page.Body[offset:], raw)
+	pointers := page.Body[:(page.NumCells+1)*CellPointerSize]
+	copy(pointers[(cellNum+1)*CellPointerSize:], pointers[cellNum*CellPointerSize:])
+	page.NumCells++
+	page.setCellOffset(cellNum, offset)
+	return true
+}
+
+// removeCell removes cell cellNum of a leaf page.
+func (page *Page) removeCell(cellNum int32) {
+	offset := page.cellOffset(cellNum)
+	size := cellSize(page.Body[offset:])
+	pointers := page.Body[:page.NumCells*CellPointerSize]
+	copy(pointers[cellNum*CellPointerSize:], pointers[(cellNum+1)*CellPointerSize:])
+	page.NumCells--
+	page.setCellOffset(page.NumCells, 0)
+	if page.NumCells == 0 {
+		page.setLeafCells(nil)
+		return
+	}
+	page.release(offset, size)
+}
+
+// defragment moves every cell to the end of the page, leaving all the free
+// space in a single gap before the content area.
+func (page *Page) defragment() {
+	page.setLeafCells(page.leafCells())
+}
+
+// leafCells returns copies of the encoded cells of a leaf page, in key order.
+func (page *Page) leafCells() [][]byte {
+	cells := make([][]byte, page.NumCells)
+	for i := range cells {
+		cells[i] = append([]byte(nil), page.cellBytes(int32(i))...)
+	}
+	return cells
+}
+
+// setLeafCells replaces the content of a leaf page by cells, which must fit.
+func (page *Page) setLeafCells(cells [][]byte) {
+	page.Body = [LeafBodySize]byte{}
+	page.NumCells = int32(len(cells))
+	page.FirstFreeBlock = 0
+	page.FragmentedBytes = 0
+	offset := int32(LeafBodySize)
+	for i, cell := range cells {
+		offset -= int32(len(cell))
+		copy(page.Body[offset:], cell)
+		page.setCellOffset(int32(i), offset)
+	}
+	page.CellContent = offset
+	if offset == LeafBodySize {
+		page.CellContent = 0
+	}
+}
+
+// cellsSize returns the room cells take in a leaf page, pointers included.
+func cellsSize(cells [][]byte) int32 {
+	size := int32(0)
+	for _, cell := range cells {
+		size += int32(len(cell)) + CellPointerSize
+	}
+	return size
+}
+
+// splitCells returns the number of cells that go to the left page when cells
+// are shared by two leaves, so that both get about the same number of bytes.
+func splitCells(cells [][]byte) int {
+	half := cellsSize(cells) / 2
+	size := int32(0)
+	n := 0
+	for ; n < len(cells)-1; n++ {
+		size += int32(len(cells[n])) + CellPointerSize
+		if size >= half {
+			return n + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,323 @@
+package main
+
+import "math"
+
+// A snapshot reads the table as it was when it was taken, while writes go
+// on. Every write bumps the version of the pager, and while snapshots are
+// open a page about to change first has its image kept, tagged with the
+// current version, unless it has an image recent enough for the newest
+// snapshot already. A snapshot taken at version v reads a page from its
+// oldest image tagged v or later or, if it has none, from the pager, the
+// page being unchanged since v. The images older than the oldest open
+// snapshot are dropped, all of them once the last snapshot is closed.
+
+// snapshotCacheSize is the number of pages a snapshot keeps once read.
+const snapshotCacheSize = 16
+
+type pageVersion struct {
+	version uint64
+	page    *Page
+}
+
+// Snapshot is a read-only view of a table as of when it was taken: the writes
+// made since, by any goroutine, are not seen, and they do not wait for the
+// snapshot. A snapshot is used by one goroutine at a time and must be closed,
+// before its table is.
+type Snapshot struct {
+	table   *Table
+	pager   *Pager
+	version uint64
+	// view is the table as the snapshot reads it, pages the pages it read
+	// last.
+	view   *Table
+	pages  *PageCache
+	closed bool
+}
+
+// Snapshot takes a snapshot of table. The images of the pages changed while
+// it is open are kept in memory, it should not stay open for longer than
+// needed.
+func (table *Table) Snapshot() (*Snapshot, error) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	version, err := table.Pager.beginSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{
+		table:   table,
+		pager:   table.Pager,
+		version: version,
+		pages:   NewPageCache(snapshotCacheSize),
+	}
+	snap.view = &Table{
+		RootPageNum: table.RootPageNum,
+		Pager:       table.Pager,
+		snapshot:    snap,
+	}
+	return snap, nil
+}
+
+// read runs f on the view of a snapshot of table, closed once f returns.
+func (table *Table) read(f func(view *Table) error) error {
+	snap, err := table.Snapshot()
+	if err != nil {
+		return err
+	}
+	err = f(snap.view)
+	closeErr := snap.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close releases the snapshot, closing it again does nothing.
+func (snap *Snapshot) Close() error {
+	table := snap.table
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if snap.closed {
+		return nil
+	}
+	snap.closed = true
+	return snap.pager.endSnapshot(snap.version, table.tx != nil)
+}
+
+func (snap *Snapshot) SelectAll() ([]Row, error) {
+	return snap.SelectRange(math.MinInt32, math.MaxInt32)
+}
+
+// SelectRange returns the rows of the snapshot whose key is between low and
+// high, both included, in key order.
+func (snap *Snapshot) SelectRange(low int32, high int32) ([]Row, error) {
+	return snap.view.selectRange(low, high)
+}
+
+// Find returns the row of the snapshot with the given key, or a RowNotFound
+// error.
+func (snap *Snapshot) Find(key int32) (*Row, error) {
+	return snap.view.find(key)
+}
+
+// GetPage returns page pageIdx as of the snapshot, or nil if there is no such
+// page. The page may be shared with other snapshots and must not be
+// modified. A snapshot creates no page, createIfNotExists is ignored.
+func (snap *Snapshot) GetPage(pageIdx int32, createIfNotExists bool) (*Page, error) {
+	if snap.closed {
+		return nil, DBError{SnapshotClosed}
+	}
+	if page := snap.pages.Get(pageIdx); page != nil {
+		return page, nil
+	}
+	snap.table.mu.Lock()
+	page, err := snap.pager.snapshotPage(snap.version, pageIdx)
+	snap.table.mu.Unlock()
+	if err != nil || page == nil {
+		return nil, err
+	}
+	snap.pages.Put(page)
+	for snap.pages.Full() {
+		snap.pages.Remove(snap.pages.Victim().PageNum)
+	}
+	return page, nil
+}
+
+// Unpin does nothing, the pages of a snapshot are never evicted while in
+// use.
+func (snap *Snapshot) Unpin(page *Page) {}
+
+// beginSnapshot takes the shared lock for a snapshot and returns the version
+// it reads.
+func (pager *Pager) beginSnapshot() (uint64, error) {
+	err := pager.beginRead()
+	if err != nil {
+		return 0, err
+	}
+	if pager.snapshots == nil {
+		pager.snapshots = make(map[uint64]int)
+	}
+	pager.snapshots[pager.version]++
+	pager.newestSnapshot = pager.version
+	return pager.version, nil
+}
+
+// endSnapshot forgets a snapshot taken at version and drops the images no
+// open snapshot reads anymore. The shared lock is released with the last
+// snapshot, unless keep tells that it belongs to a transaction.
+func (pager *Pager) endSnapshot(version uint64, keep bool) error {
+	pager.snapshots[version]--
+	if pager.snapshots[version] == 0 {
+		delete(pager.snapshots, version)
+	}
+	if len(pager.snapshots) == 0 {
+		pager.versions = nil
+		if keep || pager.lockLevel != LockShared {
+			return nil
+		}
+		return pager.endTransaction()
+	}
+	oldest := uint64(math.MaxUint64)
+	pager.newestSnapshot = 0
+	for version := range pager.snapshots {
+		if version < oldest {
+			oldest = version
+		}
+		if version > pager.newestSnapshot {
+			pager.newestSnapshot = version
+		}
+	}
+	for pageNum, versions := range pager.versions {
+		i := 0
+		for i < len(versions) && versions[i].version < oldest {
+			i++
+		}
+		if i == len(versions) {
+			delete(pager.versions, pageNum)
+		} else {
+			pager.versions[pageNum] = versions[i:]
+		}
+	}
+	return nil
+}
+
+// snapshotPage returns page pageNum as of version.
+func (pager *Pager) snapshotPage(version uint64, pageNum int32) (*Page, error) {
+	for _, v := range pager.versions[pageNum] {
+		if v.version >= version {
+			return v.page, nil
+		}
+	}
+	return pager.currentPage(pageNum)
+}
+
+// currentPage returns a copy of page pageNum as the last write left it, or
+// nil if there is no such page.
+func (pager *Pager) currentPage(pageNum int32) (*Page, error) {
+	page, err := pager.GetPage(pageNum, false)
+	if err != nil || page == nil {
+		return nil, err
+	}
+	defer pager.Unpin(page)
+	current := *page
+	current.dirty = false
+	current.pinCount = 0
+	return &current, nil
+}
+
+// needsImage reports whether an open snapshot reads page pageNum as it is
+// now, its image must then be kept before it changes.
+func (pager *Pager) needsImage(pageNum int32) bool {
+	if len(pager.snapshots) == 0 {
+		return false
+	}
+	versions := pager.versions[pageNum]
+	return len(versions) == 0 || versions[len(versions)-1].version < pager.newestSnapshot
+}
+
+// keepImage keeps a copy of page as its image at the current version.
+func (pager *Pager) keepImage(page *Page) {
+	image := *page
+	image.dirty = false
+	image.pinCount = 0
+	if pager.versions == nil {
+		pager.versions = make(map[int32][]pageVersion)
+	}
+	pager.versions[page.PageNum] = append(pager.versions[page.PageNum], pageVersion{
+		version: pager.version,
+		page:    &image,
+	})
+}
+
+// preserve keeps the image of page, which is about to change, if a snapshot
+// reads it.
+func (pager *Pager) preserve(page *Page) {
+	if pager.needsImage(page.PageNum) {
+		pager.keepImage(page)
+	}
+}
+
+// preservePage is preserve for a page that may not be in the cache.
+func (pager *Pager) preservePage(pageNum int32) error {
+	if !pager.needsImage(pageNum) {
+		return nil
+	}
+	page, err := pager.currentPage(pageNum)
+	if err != nil || page == nil {
+		return err
+	}
+	pager.keepImage(page)
+	return nil
+}
+
+// preserveTransaction keeps the images of the pages the current transaction
+// changed before it is rolled back: those in the cache, written to the
+// database file or to the WAL, and the pages it added.
+func (pager *Pager) preserveTransaction() error {
+	if len(pager.snapshots) == 0 {
+		return nil
+	}
+	changed := make(map[int32]bool)
+	for _, page := range pager.Cache.Pages() {
+		if page.dirty {
+			changed[page.PageNum] = true
+		}
+	}
+	for pageNum := range pager.journaled {
+		changed[pageNum] = true
+	}
+	if pager.wal != nil {
+		for pageNum := range pager.wal.pending {
+			changed[pageNum] = true
+		}
+	}
+	for pageNum := pager.dbSize; pageNum < pager.PageNums; pageNum++ {
+		changed[pageNum] = true
+	}
+	delete(changed, HeaderPageNum)
+	for pageNum := range changed {
+		err := pager.preservePage(pageNum)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// preserveCommitted keeps the images of the pages other connections changed
+// in the WAL since index was its index, as index has them, and makes their
+// transactions a new version.
+func (pager *Pager) preserveCommitted(index map[int32]int64) error {
+	if len(pager.snapshots) == 0 {
+		return nil
+	}
+	changed := false
+	for pageNum, offset := range pager.wal.index {
+		if index[pageNum] == offset {
+			continue
+		}
+		changed = true
+		if pageNum == HeaderPageNum || pageNum >= pager.PageNums || !pager.needsImage(pageNum) {
+			continue
+		}
+		var bs [PageSize]byte
+		var err error
+		if index[pageNum] != 0 {
+			err = pager.wal.readFrame(index[pageNum], bs[:])
+		} else {
+			_, err = pager.File.ReadAt(bs[:], int64(PageSize)*int64(pageNum))
+		}
+		if err != nil {
+			return err
+		}
+		page, err := pager.decodePage(pageNum, bs)
+		if err != nil {
+			return err
+		}
+		pager.keepImage(&page)
+	}
+	if changed {
+		pager.version++
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Synchronous tells which fsyncs a commit makes, trading durability for
+// speed. The levels are those of SQLite, Level gives their number there,
+// which is one less than the constant as the zero value is the default.
+type Synchronous int
+
+const (
+	// SynchronousDefault, the zero value, is SynchronousFull.
+	SynchronousDefault Synchronous = iota
+	// SynchronousOff never syncs, a power loss can corrupt the database.
+	SynchronousOff
+	// SynchronousNormal is SynchronousFull in rollback journal mode. In WAL
+	// mode commits do not sync the WAL, which is synced before a checkpoint
+	// instead: a power loss can lose the last transactions but does not
+	// corrupt the database.
+	SynchronousNormal
+	// SynchronousFull syncs the rollback journal before the database file is
+	// modified, and the database file, or the WAL, at every commit. A
+	// committed transaction survives a power loss.
+	SynchronousFull
+	// SynchronousExtra is SynchronousFull, also syncing the directory of the
+	// database after the journal or the WAL is created or deleted, so that
+	// a committed transaction is not undone by a journal coming back after
+	// a power loss.
+	SynchronousExtra
+)
+
+// ParseSynchronous parses the value of PRAGMA synchronous, a level name or
+// its number as in SQLite: 0 for OFF, 1 for NORMAL, 2 for FULL and 3 for
+// EXTRA.
+func ParseSynchronous(value string) (Synchronous, error) {
+	levels := []Synchronous{SynchronousOff, SynchronousNormal, SynchronousFull, SynchronousExtra}
+	if n, err := strconv.Atoi(value); err == nil {
+		if n < 0 || n >= len(levels) {
+			return 0, DBError{InvalidStatement}
+		}
+		return levels[n], nil
+	}
+	for _, level := range levels {
+		if strings.EqualFold(value, level.String()) {
+			return level, nil
+		}
+	}
+	return 0, DBError{InvalidStatement}
+}
+
+// Level returns the number of level in SQLite, that of SynchronousFull for
+// SynchronousDefault.
+func (level Synchronous) Level() int {
+	return int(level.resolve() - SynchronousOff)
+}
+
+// resolve returns the level SynchronousDefault stands for, any other level
+// is returned as is.
+func (level Synchronous) resolve() Synchronous {
+	if level == SynchronousDefault {
+		return SynchronousFull
+	}
+	return level
+}
+
+func (level Synchronous) String() string {
+	switch level.resolve() {
+	case SynchronousOff:
+		return "OFF"
+	case SynchronousNormal:
+		return "NORMAL"
+	case SynchronousFull:
+		return "FULL"
+	case SynchronousExtra:
+		return "EXTRA"
+	}
+	return strconv.Itoa(int(level))
+}
+
+// syncFile syncs file unless level is SynchronousOff, counting the sync in
+// syncs.
+func syncFile(file File, level Synchronous, syncs *int64) error {
+	if level == SynchronousOff {
+		return nil
+	}
+	*syncs++
+	return file.Sync()
+}
+
+// syncDir syncs the directory holding path in SynchronousExtra, making the
+// creation or the deletion of path durable.
+func syncDir(vfs VFS, path string, level Synchronous, syncs *int64) error {
+	if level != SynchronousExtra {
+		return nil
+	}
+	*syncs++
+	return vfs.SyncDir(path)
+}
+
+func (pager *Pager) sync(file File) error {
+	return syncFile(file, pager.Synchronous, &pager.Syncs)
+}
+
+func (pager *Pager) syncDir(path string) error {
+	return syncDir(pager.vfs, path, pager.Synchronous, &pager.Syncs)
+}
+
+// SetSynchronous changes the synchronous level of table, as PRAGMA
+// synchronous does.
+func (table *Table) SetSynchronous(level Synchronous) {
+	table.lock()
+	defer table.unlock()
+	table.setSynchronous(level)
+}
+
+func (table *Table) setSynchronous(level Synchronous) {
+	level = level.resolve()
+	table.options.Synchronous = level
+	table.Pager.Synchronous = level
+	if table.Pager.wal != nil {
+		table.Pager.wal.Synchronous = level
+	}
+}
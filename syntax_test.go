@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -21,4 +22,158 @@ func TestColumnNumNotMatch(t *testing.T) {
 	sql := "insert 1"
 	_, err := PrepareStatement(sql)
 	assert.EqualValues(t, DBError{InvalidStatement}, err)
-}
\ No newline at end of file
+}
+
+func TestDeleteStatement(t *testing.T) {
+	cases := map[string]KeyRange{
+		"delete from users":                           FullRange,
+		"delete from users where id = 5":              {Low: 5, High: 5},
+		"DELETE FROM users WHERE id>=5 AND id<10":     {Low: 5, High: 9},
+		"delete from users where id > 5 and id <= 10": {Low: 6, High: 10},
+		"delete from users where id < -2147483648":    {Low: 1, High: 0},
+		"delete from users where id > 3 and id < 2":   {Low: 1, High: 0},
+		"delete from users where id <= 2147483647":    FullRange,
+		"delete from users where id > 1 and id >= 7":  {Low: 7, High: 2147483647},
+	}
+	for sql, where := range cases {
+		s, err := PrepareStatement(sql)
+		assert.Nil(t, err, sql)
+		assert.Equal(t, StatementDelete, s.StatementType, sql)
+		assert.Equal(t, where, s.Where, sql)
+	}
+
+	for _, sql := range []string{
+		"delete users",
+		"delete from users where",
+		"delete from users where id = x",
+		"delete from users where name = 5",
+		"delete from users where id = 5 or id = 6",
+		"delete from users where id == 5",
+	} {
+		_, err := PrepareStatement(sql)
+		assert.EqualValues(t, DBError{InvalidStatement}, err, sql)
+	}
+}
+
+func TestUpdateStatement(t *testing.T) {
+	s, err := PrepareStatement("update users set name = john, email='john@example.com' where id = 3")
+	assert.Nil(t, err)
+	assert.Equal(t, StatementUpdate, s.StatementType)
+	assert.Equal(t, ColumnName|ColumnEmail, s.Set)
+	assert.Equal(t, "john", string(bytes.Trim(s.Row.Name[:], "\x00")))
+	assert.Equal(t, "john@example.com", string(bytes.Trim(s.Row.Email[:], "\x00")))
+	assert.Equal(t, KeyRange{Low: 3, High: 3}, s.Where)
+
+	s, err = PrepareStatement("UPDATE users SET id = 7")
+	assert.Nil(t, err)
+	assert.Equal(t, ColumnID, s.Set)
+	assert.EqualValues(t, 7, s.Row.ID)
+	assert.Equal(t, FullRange, s.Where)
+
+	_, err = PrepareStatement("update users set name = LoremipsumdolorsitametLoremipsumdolorsitamet")
+	assert.EqualValues(t, DBError{NameTooLong}, err)
+	for _, sql := range []string{
+		"update users name = john",
+		"update users set",
+		"update users set age = 3",
+		"update users set id = x",
+		"update users set name = john email = x",
+		"update users set name = john where id",
+	} {
+		_, err := PrepareStatement(sql)
+		assert.EqualValues(t, DBError{InvalidStatement}, err, sql)
+	}
+}
+
+func TestInsertConflictClause(t *testing.T) {
+	cases := map[string]ConflictMode{
+		"insert 1 john john@example.com":            ConflictAbort,
+		"insert or replace 1 john john@example.com": ConflictReplace,
+		"INSERT OR IGNORE 1 john john@example.com":  ConflictIgnore,
+	}
+	for sql, onConflict := range cases {
+		s, err := PrepareStatement(sql)
+		assert.Nil(t, err, sql)
+		assert.Equal(t, onConflict, s.OnConflict, sql)
+		assert.EqualValues(t, 1, s.Row.ID, sql)
+	}
+	_, err := PrepareStatement("insert or fail 1 john john@example.com")
+	assert.EqualValues(t, DBError{InvalidStatement}, err)
+	_, err = PrepareStatement("insert or replace 1 john")
+	assert.EqualValues(t, DBError{InvalidStatement}, err)
+}
+
+func TestVacuumStatement(t *testing.T) {
+	s, err := PrepareStatement("vacuum")
+	assert.Nil(t, err)
+	assert.Equal(t, StatementVacuum, s.StatementType)
+	_, err = PrepareStatement("vacuum users")
+	assert.EqualValues(t, DBError{InvalidStatement}, err)
+}
+
+func TestTransactionStatements(t *testing.T) {
+	cases := map[string]StatementType{
+		"begin":             StatementBegin,
+		"BEGIN TRANSACTION": StatementBegin,
+		"commit":            StatementCommit,
+		"end transaction":   StatementCommit,
+		"rollback":          StatementRollback,
+	}
+	for sql, statementType := range cases {
+		s, err := PrepareStatement(sql)
+		assert.Nil(t, err, sql)
+		assert.Equal(t, statementType, s.StatementType, sql)
+	}
+	for _, sql := range []string{"begin work", "commit transaction now"} {
+		_, err := PrepareStatement(sql)
+		assert.EqualValues(t, DBError{InvalidStatement}, err, sql)
+	}
+}
+
+func TestSavepointStatements(t *testing.T) {
+	cases := map[string]Statement{
+		"savepoint a":                         {StatementType: StatementSavepoint, Savepoint: "a"},
+		"release a":                           {StatementType: StatementRelease, Savepoint: "a"},
+		"RELEASE SAVEPOINT a":                 {StatementType: StatementRelease, Savepoint: "a"},
+		"rollback to a":                       {StatementType: StatementRollbackTo, Savepoint: "a"},
+		"rollback transaction to savepoint a": {StatementType: StatementRollbackTo, Savepoint: "a"},
+	}
+	for sql, statement := range cases {
+		s, err := PrepareStatement(sql)
+		assert.Nil(t, err, sql)
+		assert.Equal(t, statement, *s, sql)
+	}
+	for _, sql := range []string{"savepoint", "savepoint a b", "release", "rollback to"} {
+		_, err := PrepareStatement(sql)
+		assert.EqualValues(t, DBError{InvalidStatement}, err, sql)
+	}
+}
+
+func TestPragmaStatement(t *testing.T) {
+	cases := map[string]string{
+		"pragma synchronous":           "",
+		"PRAGMA synchronous = NORMAL":  "NORMAL",
+		"pragma synchronous=0":         "0",
+		"pragma synchronous = 'extra'": "extra",
+	}
+	for sql, value := range cases {
+		s, err := PrepareStatement(sql)
+		assert.Nil(t, err, sql)
+		assert.Equal(t, StatementPragma, s.StatementType, sql)
+		assert.Equal(t, "synchronous", s.Pragma, sql)
+		assert.Equal(t, value, s.PragmaValue, sql)
+	}
+	for _, sql := range []string{"pragma", "pragma page_size", "pragma synchronous = 4", "pragma synchronous = fast", "pragma synchronous off"} {
+		_, err := PrepareStatement(sql)
+		assert.EqualValues(t, DBError{InvalidStatement}, err, sql)
+	}
+	for value, level := range map[string]Synchronous{"0": SynchronousOff, "1": SynchronousNormal, "full": SynchronousFull, "3": SynchronousExtra} {
+		parsed, err := ParseSynchronous(value)
+		assert.Nil(t, err, value)
+		assert.Equal(t, level, parsed, value)
+	}
+	// the numbers are those of SQLite, the default being FULL
+	for level, n := range map[Synchronous]int{SynchronousDefault: 2, SynchronousOff: 0, SynchronousNormal: 1, SynchronousFull: 2, SynchronousExtra: 3} {
+		assert.Equal(t, n, level.Level(), level)
+	}
+}
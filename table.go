@@ -2,35 +2,101 @@ package main
 
 import (
 	"fmt"
-	"os"
-)
-
-const (
-	TableMaxPage = 100
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
 )
 
+// Table is safe for concurrent use: writes are made one at a time, and reads
+// are made on snapshots, so that they neither wait for the writes nor make
+// them wait.
 type Table struct {
 	RootPageNum int32
 	Pager       *Pager
 	// TODO: read from root node
 	PageNums int32
+	options  Options
+	// tx is the explicit transaction in progress, if any.
+	tx *Tx
+	// mu is held by the exported methods that write for as long as they run,
+	// and by the snapshots for each page they read. The unexported methods
+	// expect it held.
+	mu sync.Mutex
+	// snapshot is set for the view of the table a snapshot reads through.
+	snapshot *Snapshot
 }
 
 type Pager struct {
+	Header   FileHeader
 	PageNums int32
-	// TODO: -> slice
-	Pages      [TableMaxPage]*Page
-	File       *os.File
+	// Cache holds the resident pages; least recently used unpinned pages are
+	// written back if dirty and dropped once it grows past its capacity.
+	Cache      *PageCache
+	File       File
+	vfs        VFS
 	FileLength int64
+	// PagesWritten counts the pages written to File, by Flush or by evicting
+	// dirty pages.
+	PagesWritten int64
+	// Syncs counts the fsyncs of File, of the journal and of their
+	// directory.
+	Syncs       int64
+	Synchronous Synchronous
+	AutoVacuum  bool
+	// BusyTimeout is how long a lock held by another connection is waited
+	// for before failing with a Busy error.
+	BusyTimeout time.Duration
+	// VerifyChecksums makes reading a page check its checksum.
+	VerifyChecksums bool
+	// lockLevel is the lock held on File. loaded is set once Header is
+	// read, Header and the cache are then checked against the file whenever
+	// a shared lock is taken.
+	lockLevel LockLevel
+	loaded    bool
+	// dbSize is the number of pages of the database file as of the last
+	// commit.
+	dbSize int32
+	// journal is the rollback journal of the current transaction, nil until
+	// the transaction first writes to File. journaled tells which pages it
+	// already holds.
+	journalPath   string
+	journal       File
+	journalHeader JournalHeader
+	journalSize   int64
+	journalSynced bool
+	journaled     map[int32]bool
+	// wal is the write-ahead log in WAL mode, nil otherwise.
+	wal *WAL
+	// savepoints are the savepoints of the current transaction, innermost
+	// last.
+	savepoints []*savepoint
+	// version counts the writes made to the table. snapshots counts the
+	// open snapshots by the version they were taken at, newestSnapshot being
+	// the latest of those versions, and versions holds the images pages had
+	// before the writes made since the oldest one.
+	version        uint64
+	snapshots      map[uint64]int
+	newestSnapshot uint64
+	versions       map[int32][]pageVersion
+	// memory is set for a database held in the cache alone.
+	memory *memoryState
 }
 
-func (pager *Pager) GetNewPageNum() int32 {
-	return pager.PageNums
-}
-
+// GetPage returns the page pinned in the cache. Every successful call must be
+// paired with Unpin once the caller stops using the page, otherwise the page
+// can never be evicted.
 func (pager *Pager) GetPage(pageIdx int32, createIfNotExists bool) (*Page, error) {
-	page := pager.Pages[pageIdx]
-	if page != nil {
+	if pageIdx <= HeaderPageNum {
+		return nil, DBError{PageOutOfRange}
+	}
+	err := pager.beginRead()
+	if err != nil {
+		return nil, err
+	}
+	if page := pager.Cache.Get(pageIdx); page != nil {
+		page.pinCount++
 		return page, nil
 	}
 
@@ -38,7 +104,7 @@ func (pager *Pager) GetPage(pageIdx int32, createIfNotExists bool) (*Page, error
 		if !createIfNotExists {
 			return nil, nil
 		}
-		page = &Page{
+		page := &Page{
 			CommonNodeHeader: CommonNodeHeader{
 				NodeType:   Leaf,
 				RootNode:   false,
@@ -49,29 +115,31 @@ func (pager *Pager) GetPage(pageIdx int32, createIfNotExists bool) (*Page, error
 				LeafNodeHeader: LeafNodeHeader{
 					NumCells: 0,
 				},
-				Rows: [RowsPerPage]Row{},
 			},
+			dirty: true,
 		}
-		if pageIdx == 0 {
-			page.RootNode = true
+		pager.PageNums = pageIdx + 1
+		err := pager.SetPage(pageIdx, page)
+		if err != nil {
+			return nil, err
 		}
-		pager.Pages[pageIdx] = page
-		pager.PageNums++
 		return page, nil
 	}
 
-	bs := make([]byte, PageSize)
-	n, err := pager.File.ReadAt(bs, int64(PageSize*pageIdx))
+	var bs [PageSize]byte
+	err = pager.readPage(pageIdx, bs[:])
 	if err != nil {
 		return nil, err
 	}
-	if n != PageSize {
-		panic("should a full page from file but fail")
+	newPage, err := pager.decodePage(pageIdx, bs)
+	if err != nil {
+		return nil, err
+	}
+	for _, pageNum := range newPage.references() {
+		if pageNum >= pager.PageNums {
+			return nil, corruptPage(pageIdx)
+		}
 	}
-
-	var byteArray [PageSize]byte
-	copy(byteArray[:], bs)
-	newPage := FromBytes(byteArray)
 	err = pager.SetPage(pageIdx, &newPage)
 	if err != nil {
 		return nil, err
@@ -79,29 +147,301 @@ func (pager *Pager) GetPage(pageIdx int32, createIfNotExists bool) (*Page, error
 	return &newPage, nil
 }
 
+// SetPage puts page into the cache pinned, making room by evicting unpinned
+// pages if the cache is over capacity.
 func (pager *Pager) SetPage(pageIdx int32, page *Page) error {
-	pager.Pages[pageIdx] = page
+	page.pinCount++
+	pager.Cache.Put(page)
+	for pager.memory == nil && pager.Cache.Full() {
+		victim := pager.Cache.Victim()
+		if victim == nil {
+			// everything is pinned, let the cache grow until pages are released
+			break
+		}
+		if victim.dirty {
+			err := pager.writePage(victim)
+			if err != nil {
+				return err
+			}
+		}
+		pager.Cache.Remove(victim.PageNum)
+	}
 	return nil
 }
 
-func (pager *Pager) Flush() error {
-	for idx, page := range pager.Pages {
-		if page == nil {
-			continue
+// Unpin releases a page obtained from GetPage. It accepts nil so callers can
+// defer it right after a GetPage that may not find the page.
+func (pager *Pager) Unpin(page *Page) {
+	if page == nil {
+		return
+	}
+	if page.pinCount <= 0 {
+		panic("unpin a page that is not pinned")
+	}
+	page.pinCount--
+}
+
+// MarkDirty records that page has been modified so it is written back before
+// it leaves the cache and on the next Flush. Every code path that changes a
+// page must call it, pages that are only read stay clean and are never
+// rewritten. Inside a savepoint, or while snapshots are open, the page image
+// is kept before the change.
+func (pager *Pager) MarkDirty(page *Page) {
+	pager.recordCommitted(page)
+	pager.recordPage(page)
+	pager.preserve(page)
+	page.dirty = true
+}
+
+// readPage reads the latest committed content of page pageIdx, from the WAL
+// if it is there or else from the database file.
+func (pager *Pager) readPage(pageIdx int32, bs []byte) error {
+	if pager.wal != nil {
+		found, err := pager.wal.readPage(pageIdx, bs)
+		if found || err != nil {
+			return err
 		}
+	}
+	n, err := pager.File.ReadAt(bs, int64(PageSize)*int64(pageIdx))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n != PageSize {
+		// the file ends before the end of the page
+		return corruptPage(pageIdx)
+	}
+	return nil
+}
+
+// readHeaderPage reads the header page, a file too short to hold it is not a
+// database.
+func (pager *Pager) readHeaderPage(bs []byte) error {
+	err := pager.readPage(HeaderPageNum, bs)
+	if err == corruptPage(HeaderPageNum) {
+		return DBError{NotADatabase}
+	}
+	return err
+}
+
+func (pager *Pager) writePage(page *Page) error {
+	return pager.writePages([]*Page{page})
+}
+
+// writePages writes pages that are consecutive in the file with a single
+// write call. Writing the database file takes the exclusive lock.
+func (pager *Pager) writePages(pages []*Page) error {
+	if pager.wal != nil {
+		err := pager.lock(LockReserved)
+		if err != nil {
+			return err
+		}
+		return pager.writeFrames(pages)
+	}
+	err := pager.lock(LockExclusive)
+	if err != nil {
+		return err
+	}
+	pageNums := make([]int32, len(pages))
+	for i, page := range pages {
+		pageNums[i] = page.PageNum
+	}
+	err = pager.journalPages(pageNums)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, PageSize*len(pages))
+	for i, page := range pages {
 		bs, err := page.ToBytes()
-		var byteArray [PageSize]byte
-		copy(byteArray[:], bs)
-		n, err := pager.File.WriteAt(byteArray[:], int64(PageSize*idx))
 		if err != nil {
-			fmt.Printf("write fail: %v\n", err)
 			return err
 		}
-		if n != PageSize {
-			return DBError{DBWriteFileError}
+		copy(buf[i*PageSize:], bs)
+	}
+	n, err := pager.File.WriteAt(buf, int64(PageSize)*int64(pages[0].PageNum))
+	if err != nil {
+		fmt.Printf("write fail: %v\n", err)
+		return err
+	}
+	if n != len(buf) {
+		return DBError{DBWriteFileError}
+	}
+	for _, page := range pages {
+		page.dirty = false
+	}
+	pager.PagesWritten += int64(len(pages))
+	if end := int64(PageSize) * int64(pages[len(pages)-1].PageNum+1); end > pager.FileLength {
+		pager.FileLength = end
+	}
+	return nil
+}
+
+// Flush writes the dirty pages in page order, coalescing runs of adjacent
+// pages, followed by the updated header page, and syncs the file. It ends the
+// transaction, releasing the locks on the database file.
+func (pager *Pager) Flush() error {
+	if !pager.changed() {
+		return pager.endTransaction()
+	}
+	err := pager.beginWrite()
+	if err != nil {
+		return err
+	}
+	if !pager.changed() {
+		// the changes were made to a stale cache, which was dropped
+		return pager.endTransaction()
+	}
+	if pager.AutoVacuum {
+		err := pager.releaseTrailingFreePages()
+		if err != nil {
+			return err
+		}
+	}
+	if pager.memory != nil {
+		pager.commitMemory()
+		return pager.endTransaction()
+	}
+	var dirty []*Page
+	for _, page := range pager.Cache.Pages() {
+		if page.dirty {
+			dirty = append(dirty, page)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool {
+		return dirty[i].PageNum < dirty[j].PageNum
+	})
+	for start := 0; start < len(dirty); {
+		end := start + 1
+		for end < len(dirty) && dirty[end].PageNum == dirty[end-1].PageNum+1 {
+			end++
+		}
+		err := pager.writePages(dirty[start:end])
+		if err != nil {
+			return err
+		}
+		start = end
+	}
+	err = pager.writeHeader()
+	if err != nil {
+		return err
+	}
+	if pager.wal != nil {
+		pager.dbSize = pager.PageNums
+		if pager.wal.AutoCheckpoint > 0 && pager.wal.Frames() >= pager.wal.AutoCheckpoint {
+			// the checkpoint waits for no reader, it is left to a later
+			// commit if one is active
+			err = pager.tryLock(LockExclusive)
+			if err == nil {
+				err = pager.checkpoint()
+			}
+			if err != nil && err != (DBError{Busy}) {
+				return err
+			}
+		}
+		return pager.endTransaction()
+	}
+	if pager.FileLength > int64(PageSize)*int64(pager.PageNums) {
+		var truncated []int32
+		for pageNum := pager.PageNums; pageNum < pager.dbSize; pageNum++ {
+			truncated = append(truncated, pageNum)
+		}
+		err = pager.journalPages(truncated)
+		if err != nil {
+			return err
+		}
+		err = pager.File.Truncate(int64(PageSize) * int64(pager.PageNums))
+		if err != nil {
+			return err
+		}
+	}
+	pager.FileLength = int64(PageSize) * int64(pager.PageNums)
+	err = pager.sync(pager.File)
+	if err != nil {
+		return err
+	}
+	err = pager.commitJournal()
+	if err != nil {
+		return err
+	}
+	return pager.endTransaction()
+}
+
+// changed reports whether there is anything for Flush to commit.
+func (pager *Pager) changed() bool {
+	if pager.Header.PageCount != pager.PageNums || pager.inTransaction() {
+		return true
+	}
+	for _, page := range pager.Cache.Pages() {
+		if page.dirty {
+			return true
 		}
 	}
-	return pager.File.Sync()
+	return false
+}
+
+// inTransaction reports whether pages have been written since the last
+// commit.
+func (pager *Pager) inTransaction() bool {
+	if pager.wal != nil {
+		return len(pager.wal.pending) > 0
+	}
+	return pager.journal != nil
+}
+
+// Close flushes the pager, checkpoints and removes the WAL in WAL mode, and
+// closes its file. If the flush fails the journal is left behind, and the
+// next OpenDB rolls the transaction back.
+func (pager *Pager) Close() error {
+	err := pager.Flush()
+	if err == nil {
+		err = pager.closeWAL()
+	}
+	if err != nil {
+		if pager.journal != nil {
+			pager.journal.Close()
+		}
+		if pager.wal != nil {
+			pager.wal.File.Close()
+		}
+		pager.File.Close()
+		return err
+	}
+	return pager.File.Close()
+}
+
+func (pager *Pager) writeHeader() error {
+	if pager.wal == nil {
+		err := pager.lock(LockExclusive)
+		if err != nil {
+			return err
+		}
+		err = pager.journalPages([]int32{HeaderPageNum})
+		if err != nil {
+			return err
+		}
+	}
+	pager.Header.PageCount = pager.PageNums
+	pager.Header.ChangeCounter++
+	bs, err := pager.Header.ToBytes()
+	if err != nil {
+		return err
+	}
+	if pager.wal != nil {
+		err = pager.wal.commit(bs, pager.PageNums)
+		if err != nil {
+			return err
+		}
+		pager.PagesWritten++
+		return nil
+	}
+	n, err := pager.File.WriteAt(bs, int64(PageSize)*int64(HeaderPageNum))
+	if err != nil {
+		return err
+	}
+	if n != PageSize {
+		return DBError{DBWriteFileError}
+	}
+	pager.PagesWritten++
+	return nil
 }
 
 type Row struct {
@@ -111,47 +451,203 @@ type Row struct {
 }
 
 type Options struct {
+	// DBPath is the path of the database file, or MemoryDBPath.
 	DBPath string
+	// CacheSize is the maximum number of pages kept in memory, it defaults
+	// to DefaultCacheSize.
+	CacheSize int
+	// AutoVacuum makes every flush give the free pages at the end of the
+	// file back to the file system.
+	AutoVacuum bool
+	// JournalMode is how commits are made atomic, JournalDelete by default.
+	JournalMode JournalMode
+	// WALAutoCheckpoint is the number of frames in the WAL that triggers a
+	// checkpoint, DefaultWALAutoCheckpoint if 0. A negative value disables
+	// automatic checkpoints.
+	WALAutoCheckpoint int
+	// Synchronous is which fsyncs are made, SynchronousFull by default.
+	Synchronous Synchronous
+	// VFS is where the files are, the operating system's file system if
+	// nil. It is not used for MemoryDBPath.
+	VFS VFS
+	// BusyTimeout is how long to wait for the locks held by other
+	// connections to the database, a Busy error is returned at once if 0.
+	BusyTimeout time.Duration
+	// SkipChecksumVerification reads pages without checking their
+	// checksums, which is faster but lets a corrupt page go unnoticed for
+	// as long as it decodes.
+	SkipChecksumVerification bool
 }
 
+// MemoryDBPath opens a new private database held in the page cache, no file
+// is created, whatever Options.VFS is, and its content is gone once it is
+// closed. It has no journal, the cache is never written anywhere.
+const MemoryDBPath = ":memory:"
+
 func OpenDB(opts Options) (*Table, error) {
-	file, err := os.OpenFile(opts.DBPath, os.O_RDWR|os.O_CREATE, 0666)
+	pager, err := OpenPager(opts)
 	if err != nil {
-		return nil, DBError{
-			Code: DBFileError,
-		}
+		return nil, err
+	}
+	return &Table{
+		Pager:       pager,
+		RootPageNum: RootPageNum,
+		options:     opts,
+	}, nil
+}
+
+func OpenPager(opts Options) (*Pager, error) {
+	vfs := opts.vfs()
+	if opts.DBPath == MemoryDBPath {
+		vfs = NewMemVFS()
 	}
-	fstat, err := file.Stat()
+	file, err := vfs.Open(opts.DBPath, true)
 	if err != nil {
 		return nil, DBError{
 			Code: DBFileError,
 		}
 	}
 	pager := &Pager{
-		PageNums:   int32(fstat.Size() / PageSize),
-		Pages:      [TableMaxPage]*Page{},
-		File:       file,
-		FileLength: fstat.Size(),
+		Cache:       NewPageCache(opts.CacheSize),
+		File:        file,
+		vfs:         vfs,
+		AutoVacuum:  opts.AutoVacuum,
+		Synchronous: opts.Synchronous.resolve(),
+		BusyTimeout: opts.BusyTimeout,
+		journalPath: journalPath(opts.DBPath),
+
+		VerifyChecksums: !opts.SkipChecksumVerification,
 	}
-	return &Table{
-		Pager:       pager,
-		RootPageNum: 0,
-	}, nil
+	if opts.DBPath == MemoryDBPath {
+		pager.memory = &memoryState{}
+	} else {
+		err = pager.openWAL(opts)
+	}
+	if err == nil {
+		err = pager.beginRead()
+	}
+	if err == nil {
+		err = pager.endTransaction()
+	}
+	if err != nil {
+		if pager.wal != nil {
+			pager.wal.File.Close()
+		}
+		file.Close()
+		return nil, err
+	}
+	return pager, nil
 }
 
+// readHeader loads and validates the header page, or initializes a new
+// database with an empty root leaf if the file is empty.
+func (pager *Pager) readHeader() error {
+	if pager.FileLength == 0 && (pager.wal == nil || pager.wal.commitSize == 0) {
+		pager.Header = NewFileHeader()
+		pager.PageNums = pager.Header.PageCount
+		root, err := pager.GetPage(RootPageNum, true)
+		if err != nil {
+			return err
+		}
+		root.RootNode = true
+		pager.Unpin(root)
+		if pager.memory != nil {
+			pager.commitMemory()
+		}
+		return nil
+	}
+	bs := make([]byte, PageSize)
+	err := pager.readHeaderPage(bs)
+	if err != nil {
+		return err
+	}
+	header, err := HeaderFromBytes(bs)
+	if err != nil {
+		return err
+	}
+	if pager.VerifyChecksums {
+		err = verifyChecksum(HeaderPageNum, bs)
+		if err != nil {
+			return err
+		}
+	}
+	pager.Header = header
+	pager.PageNums = header.PageCount
+	pager.dbSize = header.PageCount
+	return nil
+}
+
+// ConflictMode tells InsertRowOnConflict what to do when a row with the same
+// key already exists.
+type ConflictMode int
+
+const (
+	// ConflictAbort fails the insert with a DuplicateKey error.
+	ConflictAbort ConflictMode = iota
+	// ConflictReplace overwrites the existing row.
+	ConflictReplace
+	// ConflictIgnore keeps the existing row and drops the new one.
+	ConflictIgnore
+)
+
 func (table *Table) InsertRow(row Row) error {
-	cursor, err := table.Search(row.ID)
+	return table.InsertRowOnConflict(row, ConflictAbort)
+}
+
+func (table *Table) InsertRowOnConflict(row Row, onConflict ConflictMode) error {
+	table.lock()
+	defer table.unlock()
+	return table.insertRowOnConflict(row, onConflict)
+}
+
+func (table *Table) insertRowOnConflict(row Row, onConflict ConflictMode) error {
+	err := table.Pager.beginWrite()
 	if err != nil {
 		return err
 	}
-	return table.Insert(cursor, row)
+	cursor, err := table.search(row.ID)
+	if err != nil {
+		return err
+	}
+	page, err := table.Pager.GetPage(cursor.PageNum, false)
+	if err != nil {
+		return err
+	}
+	defer table.Pager.Unpin(page)
+	if cursor.CellNum < page.NumCells && page.CellKey(cursor.CellNum) == row.ID {
+		switch onConflict {
+		case ConflictReplace:
+			return page.Replace(row, cursor)
+		case ConflictIgnore:
+			return nil
+		default:
+			return DBError{DuplicateKey}
+		}
+	}
+	return page.Insert(row, cursor)
 }
 
 func (table *Table) Search(key int32) (*Cursor, error) {
-	page, err := table.Pager.GetPage(table.RootPageNum, true)
+	var cursor *Cursor
+	err := table.read(func(view *Table) error {
+		var err error
+		cursor, err = view.search(key)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
+	cursor.Table = table
+	return cursor, nil
+}
+
+func (table *Table) search(key int32) (*Cursor, error) {
+	pages := table.pages()
+	page, err := pages.GetPage(table.RootPageNum, true)
+	if err != nil {
+		return nil, err
+	}
+	defer pages.Unpin(page)
 	cursor, err := page.LeafNodeSearch(table, key)
 	if err != nil {
 		return nil, err
@@ -161,64 +657,295 @@ func (table *Table) Search(key int32) (*Cursor, error) {
 }
 
 func (table *Table) Insert(cursor *Cursor, row Row) error {
+	table.lock()
+	defer table.unlock()
+	err := table.Pager.beginWrite()
+	if err != nil {
+		return err
+	}
 	page, err := table.Pager.GetPage(cursor.PageNum, true)
 	if err != nil {
 		return err
 	}
+	defer table.Pager.Unpin(page)
 	return page.Insert(row, cursor)
 }
 
+// Delete removes the row with the given key, or returns a RowNotFound error.
+func (table *Table) Delete(key int32) error {
+	table.lock()
+	defer table.unlock()
+	return table.delete(key)
+}
+
+func (table *Table) delete(key int32) error {
+	err := table.Pager.beginWrite()
+	if err != nil {
+		return err
+	}
+	cursor, err := table.search(key)
+	if err != nil {
+		return err
+	}
+	page, err := table.Pager.GetPage(cursor.PageNum, false)
+	if err != nil {
+		return err
+	}
+	defer table.Pager.Unpin(page)
+	if cursor.CellNum >= page.NumCells || page.CellKey(cursor.CellNum) != key {
+		return DBError{RowNotFound}
+	}
+	return page.Delete(cursor)
+}
+
+// Update replaces the row with the given key by row. The row is rewritten in
+// its leaf unless its key changes, in which case it is deleted and row
+// inserted.
+func (table *Table) Update(key int32, row Row) error {
+	table.lock()
+	defer table.unlock()
+	return table.update(key, row)
+}
+
+func (table *Table) update(key int32, row Row) error {
+	err := table.Pager.beginWrite()
+	if err != nil {
+		return err
+	}
+	cursor, err := table.search(key)
+	if err != nil {
+		return err
+	}
+	page, err := table.Pager.GetPage(cursor.PageNum, false)
+	if err != nil {
+		return err
+	}
+	if cursor.CellNum >= page.NumCells || page.CellKey(cursor.CellNum) != key {
+		table.Pager.Unpin(page)
+		return DBError{RowNotFound}
+	}
+	if row.ID == key {
+		err = page.Replace(row, cursor)
+		table.Pager.Unpin(page)
+		return err
+	}
+	table.Pager.Unpin(page)
+	_, err = table.find(row.ID)
+	if err == nil {
+		return DBError{DuplicateKey}
+	}
+	if err != (DBError{RowNotFound}) {
+		return err
+	}
+	err = table.delete(key)
+	if err != nil {
+		return err
+	}
+	return table.insertRowOnConflict(row, ConflictAbort)
+}
+
+// DeleteRange removes the rows whose key is between low and high, both
+// included, and returns how many were removed.
+func (table *Table) DeleteRange(low int32, high int32) (int, error) {
+	table.lock()
+	defer table.unlock()
+	return table.deleteRange(low, high)
+}
+
+func (table *Table) deleteRange(low int32, high int32) (int, error) {
+	rows, err := table.selectRange(low, high)
+	if err != nil {
+		return 0, err
+	}
+	for i, row := range rows {
+		err = table.delete(row.ID)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(rows), nil
+}
+
 func (table *Table) SelectAll() ([]Row, error) {
+	return table.SelectRange(math.MinInt32, math.MaxInt32)
+}
+
+// SelectRange returns the rows whose key is between low and high, both
+// included, in key order.
+func (table *Table) SelectRange(low int32, high int32) ([]Row, error) {
 	var rows []Row
-	cursor, err := table.TableStart()
+	err := table.read(func(view *Table) error {
+		var err error
+		rows, err = view.selectRange(low, high)
+		return err
+	})
+	return rows, err
+}
+
+func (table *Table) selectRange(low int32, high int32) ([]Row, error) {
+	var rows []Row
+	cursor, err := table.seek(low)
 	if err != nil {
 		return nil, err
 	}
 	for !cursor.EndOfTable {
-		row, err := table.GetRowByCursor(&cursor, false)
+		row, err := table.getRowByCursor(&cursor, false)
+		if err != nil {
+			return nil, err
+		}
+		err = cursor.advance()
 		if err != nil {
 			return nil, err
 		}
-		cursor.Advance()
 		if row == nil {
 			continue
 		}
+		if row.ID > high {
+			break
+		}
 		rows = append(rows, *row)
 	}
 	return rows, nil
 }
 
-func (table *Table) Close() error {
+// Find returns the row with the given key, or a RowNotFound error.
+func (table *Table) Find(key int32) (*Row, error) {
+	var row *Row
+	err := table.read(func(view *Table) error {
+		var err error
+		row, err = view.find(key)
+		return err
+	})
+	return row, err
+}
+
+func (table *Table) find(key int32) (*Row, error) {
+	cursor, err := table.seek(key)
+	if err != nil {
+		return nil, err
+	}
+	if cursor.EndOfTable {
+		return nil, DBError{RowNotFound}
+	}
+	row, err := table.getRowByCursor(&cursor, false)
+	if err != nil {
+		return nil, err
+	}
+	if row == nil || row.ID != key {
+		return nil, DBError{RowNotFound}
+	}
+	return row, nil
+}
+
+// Flush commits the changes made outside of a transaction, it fails while
+// one is active, which only its Commit can commit.
+func (table *Table) Flush() error {
+	table.lock()
+	defer table.unlock()
+	if table.tx != nil {
+		return DBError{TransactionActive}
+	}
 	return table.Pager.Flush()
 }
 
-func (table *Table) TableStart() (Cursor, error) {
-	cursor := Cursor{
-		Table:   table,
-		PageNum: table.RootPageNum,
-		CellNum: 0,
-		// EndOfTable: table.RowNum == 0,
+// Checkpoint commits the pending changes and, in WAL mode, copies the WAL
+// back into the database file. It fails while a transaction is active.
+func (table *Table) Checkpoint() error {
+	table.lock()
+	defer table.unlock()
+	if table.tx != nil {
+		return DBError{TransactionActive}
 	}
-	page, err := table.Pager.GetPage(table.RootPageNum, false)
+	err := table.Pager.Flush()
 	if err != nil {
-		return Cursor{}, err
+		return err
 	}
-	if page == nil {
-		cursor.EndOfTable = true
-		return cursor, nil
+	return table.Pager.Checkpoint()
+}
+
+// Close commits the pending changes and closes the database, a transaction
+// still in progress is rolled back.
+func (table *Table) Close() error {
+	table.lock()
+	defer table.unlock()
+	if table.tx != nil {
+		err := table.tx.rollback()
+		if err != nil {
+			return err
+		}
 	}
-	if page.NodeType == Leaf {
-		cursor.EndOfTable = page.NumCells==0
-		return cursor, nil
+	return table.Pager.Close()
+}
+
+// lock holds table for a write, unlock ends it. The snapshots taken after
+// the write see it, the ones taken before do not.
+func (table *Table) lock() {
+	table.mu.Lock()
+}
+
+func (table *Table) unlock() {
+	table.Pager.version++
+	table.mu.Unlock()
+}
+
+// pageReader is where the reads get their pages from: the pager, which has
+// the latest version of the pages, or a snapshot.
+type pageReader interface {
+	GetPage(pageIdx int32, createIfNotExists bool) (*Page, error)
+	Unpin(page *Page)
+}
+
+func (table *Table) pages() pageReader {
+	if table.snapshot != nil {
+		return table.snapshot
 	}
-	if page.ChildrenNum == 0 {
-		return cursor, nil
+	return table.Pager
+}
+
+func (table *Table) TableStart() (Cursor, error) {
+	return table.Seek(math.MinInt32)
+}
+
+// Seek returns a cursor at the first row whose key is not smaller than key,
+// the cursor is at the end of the table if there is no such row.
+func (table *Table) Seek(key int32) (Cursor, error) {
+	var cursor Cursor
+	err := table.read(func(view *Table) error {
+		var err error
+		cursor, err = view.seek(key)
+		return err
+	})
+	if err != nil {
+		return Cursor{}, err
 	}
-	firstChildIdx := page.Children[0].PageNum
-	cursor.PageNum = firstChildIdx
+	cursor.Table = table
 	return cursor, nil
 }
 
+func (table *Table) seek(key int32) (Cursor, error) {
+	cursor, err := table.search(key)
+	if err != nil {
+		return Cursor{}, err
+	}
+	pages := table.pages()
+	page, err := pages.GetPage(cursor.PageNum, false)
+	if err != nil {
+		return Cursor{}, err
+	}
+	defer pages.Unpin(page)
+	if cursor.CellNum >= page.NumCells {
+		// key is past the last row of this leaf, the next row, if any, is
+		// the first one of the sibling
+		if page.Sibling == 0 {
+			cursor.EndOfTable = true
+			return *cursor, nil
+		}
+		cursor.PageNum = page.Sibling
+		cursor.CellNum = 0
+	}
+	return *cursor, nil
+}
+
 type Cursor struct {
 	Table      *Table
 	PageNum    int32
@@ -226,68 +953,120 @@ type Cursor struct {
 	EndOfTable bool
 }
 
-func (cursor *Cursor) Advance() {
+func (cursor *Cursor) Advance() error {
+	table := cursor.Table
+	err := table.read(func(view *Table) error {
+		cursor.Table = view
+		return cursor.advance()
+	})
+	cursor.Table = table
+	return err
+}
+
+func (cursor *Cursor) advance() error {
 	if cursor.EndOfTable {
-		return
+		return nil
 	}
 	cursor.CellNum++
-	page, _ := cursor.Table.Pager.GetPage(cursor.PageNum, false)
+	pages := cursor.Table.pages()
+	page, err := pages.GetPage(cursor.PageNum, false)
+	if err != nil {
+		return err
+	}
+	if page == nil {
+		cursor.EndOfTable = true
+		return nil
+	}
+	defer pages.Unpin(page)
 	if cursor.CellNum >= page.NumCells {
 		if page.Sibling == 0 {
 			cursor.EndOfTable = true
-			return
+			return nil
 		}
 		cursor.PageNum = page.Sibling
 		cursor.CellNum = 0
 	}
+	return nil
 }
 
 func (table *Table) GetRowByCursor(cursor *Cursor, insert bool) (*Row, error) {
+	if insert {
+		// the page is created if it does not exist, which is a write
+		table.lock()
+		defer table.unlock()
+		return table.getRowByCursor(cursor, insert)
+	}
+	var row *Row
+	err := table.read(func(view *Table) error {
+		var err error
+		row, err = view.getRowByCursor(cursor, insert)
+		return err
+	})
+	return row, err
+}
+
+func (table *Table) getRowByCursor(cursor *Cursor, insert bool) (*Row, error) {
 	pageIdx := cursor.PageNum
-	page, err := table.Pager.GetPage(pageIdx, insert)
+	pages := table.pages()
+	page, err := pages.GetPage(pageIdx, insert)
 	if err != nil {
 		return nil, err
 	}
+	defer pages.Unpin(page)
 	if page == nil {
 		if !insert {
 			return nil, nil
 		}
 		panic("cannot get more page")
 	}
-	rowOffset := cursor.CellNum % RowsPerPage
-	return &page.Rows[rowOffset], nil
+	row, err := cellRow(pages, page.LeafCell(cursor.CellNum))
+	if err != nil {
+		return nil, onPage(err, pageIdx)
+	}
+	return &row, nil
 }
 
+// printTree prints the B+tree below page pageNum as of a snapshot.
 func (table *Table) printTree(pageNum int32, level int) error {
+	return table.read(func(view *Table) error {
+		return view.printPage(pageNum, level)
+	})
+}
+
+func (table *Table) printPage(pageNum int32, level int) error {
 	indent := func(level int) {
 		for i:=0; i<level; i++ {
 			print(" ")
 		}
 	}
-	page, err := table.Pager.GetPage(pageNum, false)
+	pages := table.pages()
+	page, err := pages.GetPage(pageNum, false)
 	if err != nil {
 		return err
 	}
+	defer pages.Unpin(page)
 	switch page.NodeType {
 	case Leaf:
 		indent(level)
 		fmt.Printf("- leaf (size %d)\n", page.NumCells)
-		for _, row := range page.Rows {
+		for i := int32(0); i < page.NumCells; i++ {
 			indent(level+1)
-			fmt.Printf("- %d\n", row.ID)
+			fmt.Printf("- %d\n", page.CellKey(i))
 		}
 		break
 	case Internal:
 		indent(level)
 		fmt.Printf("- internal (size %d)\n", page.ChildrenNum)
-		for _, child := range page.Children {
-			table.printTree(child.PageNum, level+1)
+		for _, child := range page.Children[:page.ChildrenNum] {
+			err = table.printPage(child.PageNum, level+1)
+			if err != nil {
+				return err
+			}
 			indent(level+1)
 			fmt.Printf("- key %d\n", child.Key)
 		}
 		rightMostChildIdx := page.RightmostChild
-		table.printTree(rightMostChildIdx, level+1)
+		return table.printPage(rightMostChildIdx, level+1)
 	}
 	return nil
 }
-
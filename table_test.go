@@ -2,17 +2,23 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"math"
+	"math/rand"
 	"os"
+	"runtime"
 	"sort"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestInsertAndSelect(t *testing.T) {
-	cleanup()
-	table, err := OpenDB(Options{DBPath: "db.sqlite"})
-	defer cleanup()
+	table, err := OpenDB(Options{DBPath: MemoryDBPath})
 
 	assert.Nil(t, err)
 
@@ -51,9 +57,7 @@ func TestInsertAndSelect(t *testing.T) {
 }
 
 func TestInsertAndSelectInOrder(t *testing.T) {
-	cleanup()
-	table, err := OpenDB(Options{DBPath: "db.sqlite"})
-	defer cleanup()
+	table, err := OpenDB(Options{DBPath: MemoryDBPath})
 	assert.Nil(t, err)
 	idxSlice := []int32{2, 10, 11, 3, 5, 7, 1, 4, 8, 6, 9, 0, 15, 14, 1000, 12, 10000, 9000, 8000, 7000, 6000, 5000, 4000}
 	for _, idx := range idxSlice{
@@ -132,6 +136,1805 @@ func TestPersistence(t *testing.T) {
 	}
 }
 
-func cleanup() {
-	os.Remove("db.sqlite")
-}
\ No newline at end of file
+func TestCacheEviction(t *testing.T) {
+	cleanup()
+	const cacheSize = 4
+	table, err := OpenDB(Options{DBPath: "db.sqlite", CacheSize: cacheSize})
+	assert.Nil(t, err)
+	defer cleanup()
+	const rowCount = 200
+	for i := int32(0); i < rowCount; i++ {
+		assert.Nil(t, table.InsertRow(paddedRow(i)))
+		assert.LessOrEqual(t, table.Pager.Cache.Len(), cacheSize)
+	}
+	assert.Greater(t, table.Pager.PageNums, int32(cacheSize))
+	for _, page := range table.Pager.Cache.Pages() {
+		assert.EqualValues(t, 0, page.pinCount)
+	}
+	rows, err := table.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, rowCount)
+	for i, row := range rows {
+		assert.EqualValues(t, i, row.ID)
+	}
+	assert.Nil(t, table.Close())
+
+	table, err = OpenDB(Options{DBPath: "db.sqlite", CacheSize: cacheSize})
+	assert.Nil(t, err)
+	rows, err = table.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, rowCount)
+	for i, row := range rows {
+		assert.EqualValues(t, i, row.ID)
+	}
+}
+
+func TestCacheKeepsPinnedPages(t *testing.T) {
+	cache := NewPageCache(2)
+	pages := []*Page{{}, {}, {}}
+	for i, page := range pages {
+		page.PageNum = int32(i)
+		cache.Put(page)
+	}
+	pages[0].pinCount = 1
+	assert.True(t, cache.Full())
+	assert.Equal(t, pages[1], cache.Victim())
+	cache.Get(1)
+	assert.Equal(t, pages[2], cache.Victim())
+	cache.Remove(2)
+	assert.False(t, cache.Full())
+	assert.Nil(t, cache.Get(2))
+}
+
+func TestFlushWritesOnlyDirtyPages(t *testing.T) {
+	cleanup()
+	table, err := OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	defer cleanup()
+	for i := int32(0); i < 100; i++ {
+		assert.Nil(t, table.InsertRow(paddedRow(i * 2)))
+	}
+	assert.Nil(t, table.Pager.Flush())
+	assert.EqualValues(t, table.Pager.PageNums, table.Pager.PagesWritten)
+
+	_, err = table.SelectAll()
+	assert.Nil(t, err)
+	written := table.Pager.PagesWritten
+	assert.Nil(t, table.Pager.Flush())
+	assert.EqualValues(t, written, table.Pager.PagesWritten)
+
+	for _, pageNum := range []int32{3, 5, 4} {
+		page, err := table.Pager.GetPage(pageNum, false)
+		assert.Nil(t, err)
+		table.Pager.MarkDirty(page)
+		table.Pager.Unpin(page)
+	}
+	assert.Nil(t, table.Pager.Flush())
+	// the header page is rewritten along with the dirty pages
+	assert.EqualValues(t, written+4, table.Pager.PagesWritten)
+	assert.Nil(t, table.Close())
+
+	table, err = OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	rows, err := table.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, 100)
+	assert.Nil(t, table.Close())
+	assert.EqualValues(t, 0, table.Pager.PagesWritten)
+}
+
+func TestFileHeader(t *testing.T) {
+	cleanup()
+	table, err := OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	defer cleanup()
+	assert.Nil(t, table.InsertRow(Row{ID: 1}))
+	assert.Nil(t, table.Close())
+
+	table, err = OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	header := table.Pager.Header
+	assert.Equal(t, HeaderMagic, header.Magic)
+	assert.Equal(t, FormatVersion, header.FormatVersion)
+	assert.EqualValues(t, PageSize, header.PageSize)
+	assert.EqualValues(t, 2, header.PageCount)
+	assert.EqualValues(t, 1, header.ChangeCounter)
+	assert.Nil(t, table.InsertRow(Row{ID: 2}))
+	assert.Nil(t, table.Close())
+	assert.EqualValues(t, 2, table.Pager.Header.ChangeCounter)
+
+	header.FormatVersion = FormatVersion + 1
+	bs, err := header.ToBytes()
+	assert.Nil(t, err)
+	writeFile(t, bs)
+	_, err = OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Equal(t, DBError{UnsupportedFormat}, err)
+
+	header.FormatVersion = FormatVersion
+	header.FreeListHead = header.PageCount
+	bs, err = header.ToBytes()
+	assert.Nil(t, err)
+	writeFile(t, bs)
+	_, err = OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Equal(t, DBError{NotADatabase}, err)
+
+	writeFile(t, []byte("hello world, I am not a database"))
+	_, err = OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Equal(t, DBError{NotADatabase}, err)
+}
+
+func TestPageChecksums(t *testing.T) {
+	opts := Options{DBPath: "db.sqlite", VFS: NewMemVFS()}
+	table, err := OpenDB(opts)
+	assert.Nil(t, err)
+	for i := int32(0); i < 200; i++ {
+		assert.Nil(t, table.InsertRow(paddedRow(i)))
+	}
+	assert.Nil(t, table.Close())
+
+	// a flipped bit in a leaf is caught by its checksum
+	corruptByte(t, opts, 2, PageSize-PageChecksumSize-1)
+	table, err = OpenDB(opts)
+	assert.Nil(t, err)
+	_, err = table.SelectAll()
+	assert.Equal(t, CorruptError{DBError{Corrupt}, 2}, err)
+	assert.True(t, errors.Is(err, DBError{Corrupt}))
+	assert.Equal(t, "DB error: (16), Database disk image is malformed, page 2", err.Error())
+	table.SetChecksumVerification(false)
+	rows, err := table.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, 200)
+	leaf, err := table.Pager.GetPage(2, false)
+	assert.Nil(t, err)
+	assert.Equal(t, Leaf, leaf.NodeType)
+	inconsistent := *leaf
+	table.Pager.Unpin(leaf)
+	assert.Nil(t, table.Close())
+
+	// a header that does not fit the page is corrupt, checksum or not
+	inconsistent.NumCells = 100000
+	bs, err := inconsistent.ToBytes()
+	assert.Nil(t, err)
+	file, err := opts.VFS.Open(opts.DBPath, false)
+	assert.Nil(t, err)
+	_, err = file.WriteAt(bs, 2*PageSize)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	for _, skip := range []bool{false, true} {
+		opts.SkipChecksumVerification = skip
+		table, err = OpenDB(opts)
+		assert.Nil(t, err)
+		_, err = table.SelectAll()
+		assert.Equal(t, CorruptError{DBError{Corrupt}, 2}, err)
+		assert.Nil(t, table.Close())
+	}
+
+	// a page that cannot be decoded is corrupt even without verification
+	corruptByte(t, opts, 2, 0)
+	opts.SkipChecksumVerification = true
+	table, err = OpenDB(opts)
+	assert.Nil(t, err)
+	_, err = table.SelectAll()
+	assert.Equal(t, CorruptError{DBError{Corrupt}, 2}, err)
+	assert.Nil(t, table.Close())
+
+	corruptByte(t, opts, HeaderPageNum, PageSize/2)
+	table, err = OpenDB(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, table.Close())
+	opts.SkipChecksumVerification = false
+	_, err = OpenDB(opts)
+	assert.Equal(t, CorruptError{DBError{Corrupt}, HeaderPageNum}, err)
+
+	// failing to read is not corruption
+	opts = Options{DBPath: "db.sqlite", VFS: NewMemVFS()}
+	table, err = OpenDB(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, table.Close())
+	table, err = OpenDB(opts)
+	assert.Nil(t, err)
+	cursor, err := table.Seek(0)
+	assert.Nil(t, err)
+	table.Pager.File = eioFile{table.Pager.File}
+	table.Pager.Cache = NewPageCache(0)
+	_, err = table.SelectAll()
+	assert.Equal(t, syscall.EIO, err)
+	assert.Equal(t, syscall.EIO, cursor.Advance())
+}
+
+// eioFile is a File whose reads fail.
+type eioFile struct {
+	File
+}
+
+func (eioFile) ReadAt(p []byte, off int64) (int, error) {
+	return 0, syscall.EIO
+}
+
+func TestPagerBeyondHundredPages(t *testing.T) {
+	cleanup()
+	table, err := OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	defer cleanup()
+	const pageCount = 1000
+	for i := table.Pager.PageNums; i < pageCount; i++ {
+		page, err := table.Pager.AllocatePage()
+		assert.Nil(t, err)
+		assert.EqualValues(t, i, page.PageNum)
+		table.Pager.MarkDirty(page)
+		cell := Cell{Key: i}
+		assert.True(t, page.insertCell(0, cell.encode()))
+		table.Pager.Unpin(page)
+	}
+	assert.EqualValues(t, pageCount, table.Pager.PageNums)
+	assert.Nil(t, table.Close())
+
+	table, err = OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	assert.EqualValues(t, pageCount, table.Pager.PageNums)
+	for _, pageNum := range []int32{2, 99, 100, 500, pageCount - 1} {
+		page, err := table.Pager.GetPage(pageNum, false)
+		assert.Nil(t, err)
+		assert.EqualValues(t, pageNum, page.CellKey(0))
+		table.Pager.Unpin(page)
+	}
+	for _, pageNum := range []int32{-1, HeaderPageNum} {
+		page, err := table.Pager.GetPage(pageNum, false)
+		assert.Nil(t, page)
+		assert.EqualValues(t, DBError{PageOutOfRange}, err)
+	}
+}
+
+func TestInsertManyRandomKeys(t *testing.T) {
+	cleanup()
+	table, err := OpenDB(Options{DBPath: "db.sqlite", CacheSize: 10000})
+	assert.Nil(t, err)
+	defer cleanup()
+	const rowCount = 200000
+	keys := rand.New(rand.NewSource(1)).Perm(rowCount)
+	for _, key := range keys {
+		err := table.InsertRow(Row{ID: int32(key)})
+		if !assert.Nil(t, err) {
+			return
+		}
+	}
+	depth := checkTree(t, table)
+	assert.Greater(t, depth, 2)
+	rows, err := table.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, rowCount)
+	for i, row := range rows {
+		if !assert.EqualValues(t, i, row.ID) {
+			break
+		}
+	}
+	assert.Nil(t, table.Close())
+
+	table, err = OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	assert.Equal(t, depth, checkTree(t, table))
+	for _, key := range keys[:1000] {
+		row := searchRow(t, table, int32(key))
+		assert.EqualValues(t, key, row.ID)
+	}
+}
+
+func TestInsertManySequentialKeys(t *testing.T) {
+	table, err := OpenDB(Options{DBPath: MemoryDBPath, CacheSize: 100})
+	assert.Nil(t, err)
+	for i := int32(0); i < 50000; i++ {
+		err := table.InsertRow(paddedRow(i))
+		if !assert.Nil(t, err) {
+			return
+		}
+	}
+	assert.Greater(t, checkTree(t, table), 2)
+}
+
+func TestFindAndSelectRange(t *testing.T) {
+	table, err := OpenDB(Options{DBPath: MemoryDBPath})
+	assert.Nil(t, err)
+	const rowCount = 20000
+	for _, key := range rand.New(rand.NewSource(2)).Perm(rowCount) {
+		assert.Nil(t, table.InsertRow(paddedRow(int32(key) * 2)))
+	}
+	assert.Greater(t, checkTree(t, table), 2)
+
+	for _, key := range []int32{0, 2, 5000, 2 * (rowCount - 1)} {
+		row, err := table.Find(key)
+		assert.Nil(t, err)
+		assert.Equal(t, key, row.ID)
+	}
+	for _, key := range []int32{-1, 1, 5001, 2 * rowCount} {
+		row, err := table.Find(key)
+		assert.Nil(t, row)
+		assert.Equal(t, DBError{RowNotFound}, err)
+	}
+
+	ranges := [][2]int32{{-10, 10}, {1, 1}, {3, 999}, {1000, 39000}, {39990, 50000}, {50000, 60000}}
+	for _, r := range ranges {
+		rows, err := table.SelectRange(r[0], r[1])
+		assert.Nil(t, err)
+		var expected []int32
+		for key := r[0]; key <= r[1]; key++ {
+			if key >= 0 && key < 2*rowCount && key%2 == 0 {
+				expected = append(expected, key)
+			}
+		}
+		assert.Len(t, rows, len(expected), "range %v", r)
+		for i := range rows {
+			assert.Equal(t, expected[i], rows[i].ID)
+		}
+	}
+
+	// a search that ends on a page that is not a leaf finds it corrupt
+	pageNum := RootPageNum
+	for {
+		page, err := table.Pager.GetPage(pageNum, false)
+		assert.Nil(t, err)
+		table.Pager.Unpin(page)
+		if page.NodeType == Leaf {
+			page.reset(Free)
+			break
+		}
+		pageNum = page.RightmostChild
+	}
+	_, err = table.Find(2 * rowCount)
+	assert.Equal(t, corruptPage(pageNum), err)
+	assert.Equal(t, corruptPage(pageNum), table.InsertRow(paddedRow(2*rowCount)))
+}
+
+func TestDelete(t *testing.T) {
+	cleanup()
+	table, err := OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	defer cleanup()
+	const rowCount = 20000
+	r := rand.New(rand.NewSource(3))
+	for _, key := range r.Perm(rowCount) {
+		assert.Nil(t, table.InsertRow(paddedRow(int32(key))))
+	}
+	assert.Greater(t, checkTree(t, table), 2)
+	assert.Equal(t, DBError{RowNotFound}, table.Delete(rowCount))
+
+	keys := r.Perm(rowCount)
+	for i, key := range keys[:rowCount/2] {
+		if !assert.Nil(t, table.Delete(int32(key))) {
+			return
+		}
+		if i%1000 == 0 {
+			checkTree(t, table)
+		}
+	}
+	checkTree(t, table)
+	for _, key := range keys[:100] {
+		_, err := table.Find(int32(key))
+		assert.Equal(t, DBError{RowNotFound}, err)
+	}
+	for _, key := range keys[rowCount/2 : rowCount/2+100] {
+		_, err := table.Find(int32(key))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, table.Close())
+
+	table, err = OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	rows, err := table.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, rowCount/2)
+	for _, key := range keys[rowCount/2:] {
+		if !assert.Nil(t, table.Delete(int32(key))) {
+			return
+		}
+	}
+	// the tree collapses back to a single empty root leaf
+	assert.Equal(t, 1, checkTree(t, table))
+	rows, err = table.SelectAll()
+	assert.Nil(t, err)
+	assert.Empty(t, rows)
+	stats := table.Pager.Stats()
+	assert.Equal(t, stats.PageCount-2, stats.FreePageCount)
+	assert.Nil(t, table.Close())
+
+	// freed pages are reused before the file grows again
+	table, err = OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	for _, key := range keys[:2000] {
+		assert.Nil(t, table.InsertRow(paddedRow(int32(key))))
+	}
+	checkTree(t, table)
+	assert.Equal(t, stats.PageCount, table.Pager.Stats().PageCount)
+	assert.Less(t, table.Pager.Stats().FreePageCount, stats.FreePageCount)
+
+	// a free-page list that starts at a page that is not a trunk is corrupt
+	table.Pager.Header.FreeListHead = RootPageNum
+	_, err = table.Pager.GetNewPageNum()
+	assert.Equal(t, corruptPage(RootPageNum), err)
+	_, err = table.Pager.freePageNums()
+	assert.Equal(t, corruptPage(RootPageNum), err)
+	table.Pager.Header.FreeListHead = table.Pager.PageNums
+	_, err = table.Pager.GetNewPageNum()
+	assert.Equal(t, corruptPage(table.Pager.PageNums), err)
+}
+
+func TestDeleteRange(t *testing.T) {
+	table, err := OpenDB(Options{DBPath: MemoryDBPath})
+	assert.Nil(t, err)
+	for i := int32(0); i < 1000; i++ {
+		assert.Nil(t, table.InsertRow(paddedRow(i)))
+	}
+	n, err := table.DeleteRange(100, 899)
+	assert.Nil(t, err)
+	assert.Equal(t, 800, n)
+	checkTree(t, table)
+	rows, err := table.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, 200)
+	assert.EqualValues(t, 99, rows[99].ID)
+	assert.EqualValues(t, 900, rows[100].ID)
+
+	s, err := PrepareStatement("delete from users where id < 50")
+	assert.Nil(t, err)
+	assert.Nil(t, ExecuteStatement(table, *s))
+	rows, err = table.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, 150)
+	assert.EqualValues(t, 50, rows[0].ID)
+}
+
+func TestUpdate(t *testing.T) {
+	table, err := OpenDB(Options{DBPath: MemoryDBPath})
+	assert.Nil(t, err)
+	for i := int32(0); i < 100; i++ {
+		assert.Nil(t, table.InsertRow(Row{ID: i}))
+	}
+	var name [32]byte
+	copy(name[:], "john")
+	assert.Nil(t, table.Update(42, Row{ID: 42, Name: name}))
+	row, err := table.Find(42)
+	assert.Nil(t, err)
+	assert.Equal(t, name, row.Name)
+
+	// changing the key moves the row
+	assert.Nil(t, table.Update(42, Row{ID: 1000, Name: name}))
+	_, err = table.Find(42)
+	assert.Equal(t, DBError{RowNotFound}, err)
+	row, err = table.Find(1000)
+	assert.Nil(t, err)
+	assert.Equal(t, name, row.Name)
+	checkTree(t, table)
+	assert.Equal(t, DBError{RowNotFound}, table.Update(42, Row{ID: 42}))
+
+	s, err := PrepareStatement("update users set email = 'x@y.z' where id >= 10 and id < 20")
+	assert.Nil(t, err)
+	n, err := executeUpdate(table, *s)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+	rows, err := table.SelectRange(9, 20)
+	assert.Nil(t, err)
+	for _, row := range rows {
+		email := string(bytes.Trim(row.Email[:], "\x00"))
+		if row.ID >= 10 && row.ID < 20 {
+			assert.Equal(t, "x@y.z", email)
+		} else {
+			assert.Empty(t, email)
+		}
+	}
+
+	// a new key for several rows is rejected before any row is changed
+	s, err = PrepareStatement("update users set id = 500 where id >= 10 and id < 20")
+	assert.Nil(t, err)
+	n, err = executeUpdate(table, *s)
+	assert.Equal(t, DBError{DuplicateKey}, err)
+	assert.Equal(t, 0, n)
+	_, err = table.Find(500)
+	assert.Equal(t, DBError{RowNotFound}, err)
+	rows, err = table.SelectRange(10, 19)
+	assert.Nil(t, err)
+	assert.Len(t, rows, 10)
+}
+
+func TestDuplicateKey(t *testing.T) {
+	table, err := OpenDB(Options{DBPath: MemoryDBPath})
+	assert.Nil(t, err)
+	for i := int32(0); i < 100; i++ {
+		assert.Nil(t, table.InsertRow(Row{ID: i}))
+	}
+	var name [32]byte
+	copy(name[:], "john")
+	for _, key := range []int32{0, 5, 50, 99} {
+		assert.Equal(t, DBError{DuplicateKey}, table.InsertRow(Row{ID: key, Name: name}))
+		assert.Nil(t, table.InsertRowOnConflict(Row{ID: key, Name: name}, ConflictIgnore))
+		row, err := table.Find(key)
+		assert.Nil(t, err)
+		assert.Equal(t, [32]byte{}, row.Name)
+
+		assert.Nil(t, table.InsertRowOnConflict(Row{ID: key, Name: name}, ConflictReplace))
+		row, err = table.Find(key)
+		assert.Nil(t, err)
+		assert.Equal(t, name, row.Name)
+	}
+	assert.Equal(t, DBError{DuplicateKey}, table.Update(1, Row{ID: 2}))
+	rows, err := table.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, 100)
+	checkTree(t, table)
+}
+
+func TestVacuum(t *testing.T) {
+	cleanup()
+	table, err := OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	defer cleanup()
+	const rowCount = 5000
+	r := rand.New(rand.NewSource(5))
+	for _, key := range r.Perm(rowCount) {
+		assert.Nil(t, table.InsertRow(paddedRow(int32(key))))
+	}
+	for key := 0; key < rowCount; key++ {
+		if key%4 != 0 {
+			assert.Nil(t, table.Delete(int32(key)))
+		}
+	}
+	before := table.Pager.Stats()
+	assert.Greater(t, before.FreePageCount, int32(0))
+
+	assert.Nil(t, table.Vacuum())
+	after := table.Pager.Stats()
+	assert.EqualValues(t, 0, after.FreePageCount)
+	assert.Less(t, after.PageCount, before.PageCount-before.FreePageCount)
+	fi, err := os.Stat("db.sqlite")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(after.PageCount)*PageSize, fi.Size())
+	_, err = os.Stat("db.sqlite-vacuum")
+	assert.True(t, os.IsNotExist(err))
+	checkTree(t, table)
+	rows, err := table.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, rowCount/4)
+	for i, row := range rows {
+		assert.Equal(t, paddedRow(int32(i*4)), row)
+	}
+
+	// the vacuumed tree keeps working
+	for key := 1; key < rowCount; key += 4 {
+		assert.Nil(t, table.InsertRow(paddedRow(int32(key))))
+	}
+	for key := 0; key < rowCount; key += 8 {
+		assert.Nil(t, table.Delete(int32(key)))
+	}
+	checkTree(t, table)
+	assert.Nil(t, table.Close())
+	table, err = OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	rows, err = table.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, rowCount/2-rowCount/8)
+
+	// small tables fit in the root leaf
+	for _, row := range rows[RowsPerPage:] {
+		assert.Nil(t, table.Delete(row.ID))
+	}
+	assert.Nil(t, table.Vacuum())
+	assert.Equal(t, 1, checkTree(t, table))
+	assert.EqualValues(t, 2, table.Pager.Stats().PageCount)
+	assert.Nil(t, table.Close())
+
+	// a failed swap leaves the table on the original file, unlocked
+	vfs := renameFailVFS{NewMemVFS()}
+	opts := Options{DBPath: "db.sqlite", VFS: vfs}
+	table, err = OpenDB(opts)
+	assert.Nil(t, err)
+	for i := int32(0); i < 100; i++ {
+		assert.Nil(t, table.InsertRow(paddedRow(i)))
+	}
+	assert.Equal(t, DBError{DBFileError}, table.Vacuum())
+	exists, err := vfs.Exists("db.sqlite-vacuum")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	assert.Nil(t, table.InsertRow(paddedRow(100)))
+	assert.Nil(t, table.Flush())
+	other, err := OpenDB(opts)
+	assert.Nil(t, err)
+	rows, err = other.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, 101)
+	assert.Nil(t, other.Close())
+	assert.Nil(t, table.Close())
+}
+
+// renameFailVFS is a MemVFS that fails to rename files.
+type renameFailVFS struct {
+	*MemVFS
+}
+
+func (renameFailVFS) Rename(oldPath, newPath string) error {
+	return &os.PathError{Op: "rename", Path: oldPath, Err: os.ErrPermission}
+}
+
+func TestAutoVacuum(t *testing.T) {
+	cleanup()
+	table, err := OpenDB(Options{DBPath: "db.sqlite", AutoVacuum: true})
+	assert.Nil(t, err)
+	defer cleanup()
+	const rowCount = 2000
+	for key := 0; key < rowCount; key++ {
+		assert.Nil(t, table.InsertRow(paddedRow(int32(key))))
+	}
+	assert.Nil(t, table.Close())
+	full := table.Pager.Stats().PageCount
+
+	table, err = OpenDB(Options{DBPath: "db.sqlite", AutoVacuum: true})
+	assert.Nil(t, err)
+	for key := rowCount / 2; key < rowCount; key++ {
+		assert.Nil(t, table.Delete(int32(key)))
+	}
+	assert.Nil(t, table.Close())
+	stats := table.Pager.Stats()
+	assert.Less(t, stats.PageCount, full)
+	fi, err := os.Stat("db.sqlite")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(stats.PageCount)*PageSize, fi.Size())
+
+	table, err = OpenDB(Options{DBPath: "db.sqlite", AutoVacuum: true})
+	assert.Nil(t, err)
+	assert.Equal(t, stats.PageCount, table.Pager.Stats().PageCount)
+	assert.Equal(t, stats.FreePageCount, table.Pager.Stats().FreePageCount)
+	checkTree(t, table)
+	rows, err := table.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, rowCount/2)
+	for key := rowCount / 2; key < rowCount; key++ {
+		assert.Nil(t, table.InsertRow(paddedRow(int32(key))))
+	}
+	checkTree(t, table)
+	assert.Nil(t, table.Close())
+}
+
+func TestOverflowPages(t *testing.T) {
+	cleanup()
+	table, err := OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	defer cleanup()
+	pager := table.Pager
+
+	short := Row{ID: 1}
+	copy(short.Name[:], "john")
+	copy(short.Email[:], "j@x.io")
+	cell, err := pager.NewCell(short)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, cell.Overflow)
+	assert.EqualValues(t, 4+4+6, cell.PayloadSize)
+	row, err := pager.CellRow(cell)
+	assert.Nil(t, err)
+	assert.Equal(t, short, row)
+
+	long := Row{ID: 2}
+	copy(long.Name[:], bytes.Repeat([]byte{'n'}, 32))
+	copy(long.Email[:], bytes.Repeat([]byte{'e'}, 256))
+	cell, err = pager.NewCell(long)
+	assert.Nil(t, err)
+	assert.NotEqualValues(t, 0, cell.Overflow)
+	assert.Len(t, cell.Local, MaxLocalPayload)
+	pageCount := pager.Stats().PageCount
+	assert.Nil(t, table.Close())
+
+	table, err = OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	pager = table.Pager
+	row, err = pager.CellRow(cell)
+	assert.Nil(t, err)
+	assert.Equal(t, long, row)
+	assert.Nil(t, pager.FreeCell(cell))
+	assert.EqualValues(t, 1, pager.Stats().FreePageCount)
+
+	// payloads longer than a page use a chain, built from free pages first
+	data := make([]byte, 3*OverflowDataSize+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	first, err := pager.writeOverflow(data)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, pager.Stats().FreePageCount)
+	assert.Equal(t, pageCount+3, pager.Stats().PageCount)
+	read, err := readOverflow(pager, first, int32(len(data)))
+	assert.Nil(t, err)
+	assert.Equal(t, data, read)
+	// a chain that ends too soon is corrupt at its last page
+	_, err = readOverflow(pager, first, int32(len(data)+1))
+	assert.Equal(t, corruptPage(pageCount+2), err)
+	assert.Nil(t, pager.freeOverflow(first))
+	assert.EqualValues(t, 4, pager.Stats().FreePageCount)
+
+	// so is a cell whose chain starts past the end of the database
+	assert.Nil(t, table.InsertRow(long))
+	leaf, err := pager.GetPage(table.RootPageNum, false)
+	assert.Nil(t, err)
+	raw := leaf.cellBytes(0)
+	binary.BigEndian.PutUint32(raw[CellHeaderSize+MaxLocalPayload:], uint32(pager.PageNums+10))
+	pager.Unpin(leaf)
+	_, err = table.SelectAll()
+	assert.Equal(t, corruptPage(table.RootPageNum), err)
+	assert.Equal(t, corruptPage(table.RootPageNum), table.Delete(long.ID))
+	assert.Nil(t, table.Close())
+}
+
+func TestSlottedLeafPage(t *testing.T) {
+	page := &Page{}
+	page.NodeType = Leaf
+	cells := make(map[int32][]byte)
+	check := func() {
+		assert.EqualValues(t, len(cells), page.NumCells)
+		for i := int32(0); i < page.NumCells; i++ {
+			key := page.CellKey(i)
+			assert.Equal(t, cells[key], page.cellBytes(i))
+			if i > 0 {
+				assert.Less(t, page.CellKey(i-1), key)
+			}
+		}
+		var used []byte
+		for _, cell := range cells {
+			used = append(used, cell...)
+		}
+		assert.Equal(t, LeafBodySize-int32(len(used))-page.NumCells*CellPointerSize, page.freeSpace())
+	}
+	insert := func(key int32, size int) bool {
+		row := Row{ID: key}
+		copy(row.Email[:], bytes.Repeat([]byte{byte(key)}, size))
+		cell := Cell{Key: key, Local: row.Payload()}
+		cell.PayloadSize = int32(len(cell.Local))
+		raw := cell.encode()
+		cellNum := page.LeafNodeFindCell(key)
+		if !page.insertCell(cellNum, raw) {
+			return false
+		}
+		cells[key] = raw
+		return true
+	}
+	remove := func(key int32) {
+		page.removeCell(page.LeafNodeFindCell(key))
+		delete(cells, key)
+	}
+
+	r := rand.New(rand.NewSource(7))
+	for key := int32(0); insert(key*2, r.Intn(100)); key++ {
+	}
+	check()
+	assert.Less(t, page.freeSpace(), int32(100+CellHeaderSize+4+CellPointerSize))
+	full := page.NumCells
+
+	// removed cells leave free blocks that new cells reuse
+	for key := int32(0); key < full*2; key += 6 {
+		remove(key)
+	}
+	check()
+	assert.NotEqualValues(t, 0, page.FirstFreeBlock)
+	for key := int32(1); insert(key, r.Intn(100)); key += 2 {
+	}
+	check()
+	assert.Less(t, page.freeSpace(), int32(100+CellHeaderSize+4+CellPointerSize))
+
+	// scattered free space is gathered when a cell needs it
+	for key := range cells {
+		if key%3 == 0 {
+			remove(key)
+		}
+	}
+	check()
+	assert.True(t, insert(-1, 250))
+	check()
+	page.defragment()
+	check()
+	assert.EqualValues(t, 0, page.FirstFreeBlock)
+	assert.EqualValues(t, 0, page.FragmentedBytes)
+
+	for key := range cells {
+		remove(key)
+	}
+	check()
+	assert.EqualValues(t, 0, page.CellContent)
+	assert.EqualValues(t, 0, page.FirstFreeBlock)
+	assert.EqualValues(t, LeafBodySize, page.freeSpace())
+}
+
+func TestVariableLengthRows(t *testing.T) {
+	cleanup()
+	table, err := OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	defer cleanup()
+	short := func(id int32) Row {
+		row := Row{ID: id}
+		copy(row.Name[:], "john")
+		copy(row.Email[:], "j@x.io")
+		return row
+	}
+	long := func(id int32) Row {
+		row := Row{ID: id}
+		copy(row.Name[:], bytes.Repeat([]byte{'n'}, 32))
+		copy(row.Email[:], bytes.Repeat([]byte{'e'}, 256))
+		return row
+	}
+	// short rows pack far more than RowsPerPage in a leaf
+	for i := int32(0); i < 10*RowsPerPage; i++ {
+		assert.Nil(t, table.InsertRow(short(i)))
+	}
+	assert.Equal(t, 1, checkTree(t, table))
+	assert.EqualValues(t, 2, table.Pager.Stats().PageCount)
+
+	// long rows spill into overflow pages, which are freed with them
+	for i := int32(0); i < 10*RowsPerPage; i += 2 {
+		assert.Nil(t, table.Update(i, long(i)))
+	}
+	checkTree(t, table)
+	assert.Nil(t, table.Close())
+	table, err = OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	rows, err := table.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, int(10*RowsPerPage))
+	for i, row := range rows {
+		if i%2 == 0 {
+			assert.Equal(t, long(int32(i)), row)
+		} else {
+			assert.Equal(t, short(int32(i)), row)
+		}
+	}
+	assert.Greater(t, table.Pager.Stats().PageCount, 10*RowsPerPage/2)
+	for i := int32(0); i < 10*RowsPerPage; i += 2 {
+		assert.Nil(t, table.InsertRowOnConflict(short(i), ConflictReplace))
+	}
+	checkTree(t, table)
+	// one overflow page per long row
+	assert.EqualValues(t, 5*RowsPerPage, table.Pager.Stats().FreePageCount)
+	for i := int32(0); i < 10*RowsPerPage; i++ {
+		assert.Nil(t, table.Update(i, long(i)))
+	}
+	_, err = table.DeleteRange(0, 10*RowsPerPage)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, checkTree(t, table))
+	stats := table.Pager.Stats()
+	assert.Equal(t, stats.PageCount-2, stats.FreePageCount)
+	assert.Nil(t, table.Close())
+}
+
+func TestRollbackJournal(t *testing.T) {
+	cleanup()
+	table, err := OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	defer cleanup()
+	for i := int32(0); i < 1000; i++ {
+		assert.Nil(t, table.InsertRow(paddedRow(i)))
+	}
+	assert.Nil(t, table.Close())
+	committed, err := os.ReadFile("db.sqlite")
+	assert.Nil(t, err)
+	_, err = os.Stat("db.sqlite-journal")
+	assert.True(t, os.IsNotExist(err))
+
+	// crash while the cache spills changes to the database file
+	crash := func(tail []byte) {
+		table, err := OpenDB(Options{DBPath: "db.sqlite", CacheSize: 4})
+		assert.Nil(t, err)
+		for i := int32(0); i < 1000; i += 3 {
+			assert.Nil(t, table.Delete(i))
+		}
+		for i := int32(1000); i < 1500; i++ {
+			assert.Nil(t, table.InsertRow(paddedRow(i)))
+		}
+		assert.Greater(t, table.Pager.PagesWritten, int64(0))
+		bs, err := os.ReadFile("db.sqlite")
+		assert.Nil(t, err)
+		assert.NotEqual(t, committed, bs)
+		_, err = table.Pager.journal.WriteAt(tail, table.Pager.journalSize)
+		assert.Nil(t, err)
+		table.Pager.journal.Close()
+		table.Pager.File.Close()
+	}
+	check := func() {
+		table, err := OpenDB(Options{DBPath: "db.sqlite"})
+		assert.Nil(t, err)
+		_, err = os.Stat("db.sqlite-journal")
+		assert.True(t, os.IsNotExist(err))
+		bs, err := os.ReadFile("db.sqlite")
+		assert.Nil(t, err)
+		assert.Equal(t, committed, bs)
+		checkTree(t, table)
+		rows, err := table.SelectAll()
+		assert.Nil(t, err)
+		assert.Len(t, rows, 1000)
+		assert.Nil(t, table.Close())
+	}
+	crash(nil)
+	check()
+	// a record torn by the crash is ignored
+	crash(make([]byte, 100))
+	check()
+
+	// a journal without a valid header was never synced
+	assert.Nil(t, os.WriteFile("db.sqlite-journal", []byte("garbage"), 0666))
+	check()
+}
+
+func TestWALMode(t *testing.T) {
+	cleanup()
+	opts := Options{DBPath: "db.sqlite", JournalMode: JournalWAL, WALAutoCheckpoint: -1}
+	table, err := OpenDB(opts)
+	assert.Nil(t, err)
+	defer cleanup()
+	for i := int32(0); i < 500; i++ {
+		assert.Nil(t, table.InsertRow(paddedRow(i)))
+	}
+	assert.Nil(t, table.Pager.Flush())
+	// commits only go to the WAL
+	fi, err := os.Stat("db.sqlite")
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, fi.Size())
+	_, err = os.Stat("db.sqlite-journal")
+	assert.True(t, os.IsNotExist(err))
+	assert.Greater(t, table.Pager.wal.Frames(), 0)
+	crash := func(table *Table) {
+		table.Pager.wal.File.Close()
+		table.Pager.File.Close()
+	}
+	check := func(table *Table, rowCount int) {
+		checkTree(t, table)
+		rows, err := table.SelectAll()
+		assert.Nil(t, err)
+		assert.Len(t, rows, rowCount)
+	}
+	crash(table)
+
+	// committed frames survive a crash, frames of a transaction that did
+	// not commit and torn frames do not
+	table, err = OpenDB(opts)
+	assert.Nil(t, err)
+	check(table, 500)
+	table.Pager.Cache.Capacity = 4
+	for i := int32(500); i < 1000; i++ {
+		assert.Nil(t, table.InsertRow(paddedRow(i)))
+	}
+	assert.NotEmpty(t, table.Pager.wal.pending)
+	_, err = table.Pager.wal.File.WriteAt(make([]byte, 100), table.Pager.wal.size)
+	assert.Nil(t, err)
+	crash(table)
+	table, err = OpenDB(opts)
+	assert.Nil(t, err)
+	check(table, 500)
+
+	// a checkpoint copies the WAL into the database file
+	for i := int32(500); i < 600; i++ {
+		assert.Nil(t, table.InsertRow(paddedRow(i)))
+	}
+	assert.Nil(t, table.Checkpoint())
+	assert.Equal(t, 0, table.Pager.wal.Frames())
+	fi, err = os.Stat("db.sqlite")
+	assert.Nil(t, err)
+	assert.EqualValues(t, int64(table.Pager.PageNums)*PageSize, fi.Size())
+	check(table, 600)
+	for i := int32(600); i < 700; i++ {
+		assert.Nil(t, table.InsertRow(paddedRow(i)))
+	}
+	assert.Nil(t, table.Pager.Flush())
+	crash(table)
+
+	// a WAL left behind is checkpointed when opened in another mode
+	table, err = OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	_, err = os.Stat("db.sqlite-wal")
+	assert.True(t, os.IsNotExist(err))
+	check(table, 700)
+	assert.Nil(t, table.Close())
+
+	// automatic checkpoints, and closing removes the WAL
+	opts.WALAutoCheckpoint = 10
+	table, err = OpenDB(opts)
+	assert.Nil(t, err)
+	for i := int32(700); i < 1000; i++ {
+		assert.Nil(t, table.InsertRow(paddedRow(i)))
+	}
+	assert.Nil(t, table.Pager.Flush())
+	assert.Equal(t, 0, table.Pager.wal.Frames())
+	assert.Nil(t, table.Vacuum())
+	check(table, 1000)
+	assert.Nil(t, table.Close())
+	_, err = os.Stat("db.sqlite-wal")
+	assert.True(t, os.IsNotExist(err))
+	table, err = OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	check(table, 1000)
+	assert.Nil(t, table.Close())
+}
+
+func TestTransactions(t *testing.T) {
+	for _, mode := range []JournalMode{JournalDelete, JournalWAL} {
+		cleanup()
+		opts := Options{DBPath: "db.sqlite", JournalMode: mode}
+		table, err := OpenDB(opts)
+		assert.Nil(t, err)
+		for i := int32(0); i < 500; i++ {
+			assert.Nil(t, table.InsertRow(paddedRow(i)))
+		}
+		tx, err := table.Begin()
+		assert.Nil(t, err)
+		_, err = table.Begin()
+		assert.Equal(t, DBError{TransactionActive}, err)
+		for i := int32(500); i < 600; i++ {
+			assert.Nil(t, table.InsertRow(paddedRow(i)))
+		}
+		assert.Nil(t, tx.Commit())
+		assert.Equal(t, DBError{NoTransaction}, tx.Commit())
+
+		// a rollback discards the changes, even those spilled by the cache
+		table.Pager.Cache.Capacity = 4
+		tx, err = table.Begin()
+		assert.Nil(t, err)
+		for i := int32(0); i < 600; i += 2 {
+			assert.Nil(t, table.Delete(i))
+		}
+		for i := int32(600); i < 1000; i++ {
+			assert.Nil(t, table.InsertRow(paddedRow(i)))
+		}
+		assert.Greater(t, table.Pager.PagesWritten, int64(0))
+		assert.Equal(t, DBError{TransactionActive}, table.Vacuum())
+		// only the transaction commits its changes
+		assert.Equal(t, DBError{TransactionActive}, table.Flush())
+		assert.Equal(t, DBError{TransactionActive}, table.Checkpoint())
+		assert.Nil(t, tx.Rollback())
+		assert.Equal(t, DBError{NoTransaction}, tx.Rollback())
+		checkTree(t, table)
+		rows, err := table.SelectAll()
+		assert.Nil(t, err)
+		assert.Len(t, rows, 600)
+
+		// closing rolls back a transaction left open
+		_, err = table.Begin()
+		assert.Nil(t, err)
+		assert.Nil(t, table.Delete(0))
+		assert.Nil(t, table.Close())
+		table, err = OpenDB(opts)
+		assert.Nil(t, err)
+		_, err = table.Find(0)
+		assert.Nil(t, err)
+		assert.Nil(t, table.Close())
+	}
+	cleanup()
+}
+
+func TestAutocommit(t *testing.T) {
+	cleanup()
+	table, err := OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	defer cleanup()
+	execute := func(sql string) error {
+		s, err := PrepareStatement(sql)
+		assert.Nil(t, err, sql)
+		return ExecuteStatement(table, *s)
+	}
+	dirty := func() int {
+		n := 0
+		for _, page := range table.Pager.Cache.Pages() {
+			if page.dirty {
+				n++
+			}
+		}
+		return n
+	}
+	assert.Nil(t, execute("insert 1 john john@example.com"))
+	assert.Equal(t, 0, dirty())
+	assert.Equal(t, DBError{NoTransaction}, execute("commit"))
+
+	assert.Nil(t, execute("begin"))
+	assert.Nil(t, execute("insert 2 jane jane@example.com"))
+	assert.Greater(t, dirty(), 0)
+	assert.Nil(t, execute("rollback"))
+	_, err = table.Find(2)
+	assert.Equal(t, DBError{RowNotFound}, err)
+
+	assert.Nil(t, execute("begin transaction"))
+	assert.Nil(t, execute("insert 2 jane jane@example.com"))
+	assert.Nil(t, execute("update users set name = joe where id = 1"))
+	assert.Nil(t, execute("end"))
+	assert.Equal(t, 0, dirty())
+
+	assert.Equal(t, DBError{DuplicateKey}, execute("insert 2 jane jane@example.com"))
+	rows, err := table.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, 2)
+	assert.Equal(t, "joe", string(bytes.TrimRight(rows[0].Name[:], "\x00")))
+	assert.Nil(t, table.Close())
+}
+
+func TestSavepoints(t *testing.T) {
+	for _, mode := range []JournalMode{JournalDelete, JournalWAL} {
+		cleanup()
+		opts := Options{DBPath: "db.sqlite", JournalMode: mode}
+		table, err := OpenDB(opts)
+		assert.Nil(t, err)
+		for i := int32(0); i < 300; i++ {
+			assert.Nil(t, table.InsertRow(paddedRow(i)))
+		}
+		table.Pager.Cache.Capacity = 4
+		tx, err := table.Begin()
+		assert.Nil(t, err)
+		assert.Nil(t, tx.Savepoint("a"))
+		statsA := table.Pager.Stats()
+		for i := int32(300); i < 400; i++ {
+			assert.Nil(t, table.InsertRow(paddedRow(i)))
+		}
+		assert.Nil(t, tx.Savepoint("b"))
+		statsB := table.Pager.Stats()
+		for i := int32(0); i < 400; i += 2 {
+			assert.Nil(t, table.Delete(i))
+		}
+		assert.Greater(t, table.Pager.PagesWritten, int64(0))
+
+		assert.Nil(t, tx.RollbackTo("b"))
+		checkTree(t, table)
+		rows, err := table.SelectAll()
+		assert.Nil(t, err)
+		assert.Len(t, rows, 400)
+		assert.Equal(t, statsB.PageCount, table.Pager.Stats().PageCount)
+		assert.Equal(t, statsB.FreePageCount, table.Pager.Stats().FreePageCount)
+
+		// the savepoint is still active after rolling back to it
+		assert.Nil(t, table.Delete(0))
+		assert.Nil(t, tx.RollbackTo("B"))
+		_, err = table.Find(0)
+		assert.Nil(t, err)
+
+		assert.Nil(t, tx.RollbackTo("a"))
+		checkTree(t, table)
+		rows, err = table.SelectAll()
+		assert.Nil(t, err)
+		assert.Len(t, rows, 300)
+		assert.Equal(t, statsA.PageCount, table.Pager.Stats().PageCount)
+		assert.Equal(t, DBError{NoSuchSavepoint}, tx.RollbackTo("b"))
+
+		// a released savepoint hands its changes to the one below
+		assert.Nil(t, tx.Savepoint("c"))
+		assert.Nil(t, table.InsertRow(paddedRow(1000)))
+		assert.Nil(t, table.Delete(1))
+		assert.Nil(t, tx.Release("c"))
+		assert.Equal(t, DBError{NoSuchSavepoint}, tx.Release("c"))
+		assert.Nil(t, tx.RollbackTo("a"))
+		_, err = table.Find(1000)
+		assert.Equal(t, DBError{RowNotFound}, err)
+		_, err = table.Find(1)
+		assert.Nil(t, err)
+
+		// a page image that could not be kept fails the savepoints below it
+		assert.Nil(t, tx.Savepoint("d"))
+		table.Pager.savepoints[len(table.Pager.savepoints)-1].err = errFault
+		assert.Equal(t, errFault, tx.RollbackTo("d"))
+		assert.Nil(t, tx.Release("d"))
+		assert.Equal(t, errFault, tx.RollbackTo("a"))
+		table.Pager.savepoints[0].err = nil
+
+		assert.Nil(t, table.InsertRow(paddedRow(2000)))
+		assert.Nil(t, tx.Release("a"))
+		assert.Nil(t, tx.Commit())
+		assert.Nil(t, table.Close())
+		table, err = OpenDB(opts)
+		assert.Nil(t, err)
+		checkTree(t, table)
+		rows, err = table.SelectAll()
+		assert.Nil(t, err)
+		assert.Len(t, rows, 301)
+		assert.Nil(t, table.Close())
+	}
+	cleanup()
+}
+
+func TestSavepointTransactions(t *testing.T) {
+	cleanup()
+	table, err := OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	defer cleanup()
+	execute := func(sql string) error {
+		s, err := PrepareStatement(sql)
+		assert.Nil(t, err, sql)
+		return ExecuteStatement(table, *s)
+	}
+	assert.Equal(t, DBError{NoSuchSavepoint}, execute("release x"))
+
+	// a savepoint outside a transaction starts one, committed on release
+	assert.Nil(t, execute("savepoint outer"))
+	assert.NotNil(t, table.tx)
+	assert.Nil(t, execute("insert 1 john john@example.com"))
+	assert.Nil(t, execute("savepoint inner"))
+	assert.Nil(t, execute("insert 2 jane jane@example.com"))
+	assert.Nil(t, execute("rollback to savepoint inner"))
+	assert.Nil(t, execute("insert 3 joe joe@example.com"))
+	assert.Nil(t, execute("release outer"))
+	assert.Nil(t, table.tx)
+	rows, err := table.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, 2)
+	assert.Equal(t, int32(3), rows[1].ID)
+
+	// inside BEGIN, releasing every savepoint leaves the transaction open
+	assert.Nil(t, execute("begin"))
+	assert.Nil(t, execute("savepoint s"))
+	assert.Nil(t, execute("delete from users where id = 1"))
+	assert.Nil(t, execute("release savepoint s"))
+	assert.NotNil(t, table.tx)
+	assert.Nil(t, execute("rollback"))
+	_, err = table.Find(1)
+	assert.Nil(t, err)
+	assert.Nil(t, table.Close())
+}
+
+func TestSynchronous(t *testing.T) {
+	cases := []struct {
+		mode  JournalMode
+		level Synchronous
+		// commitSyncs and checkpointSyncs are the fsyncs made by a commit
+		// and by a checkpoint of that commit.
+		commitSyncs     int64
+		checkpointSyncs int64
+	}{
+		{JournalDelete, SynchronousDefault, 3, 0},
+		{JournalDelete, SynchronousOff, 0, 0},
+		// the journal is synced before the pages are written, then before
+		// the header is, and the database file last
+		{JournalDelete, SynchronousNormal, 3, 0},
+		{JournalDelete, SynchronousFull, 3, 0},
+		// the journal directory is synced after creating and deleting it
+		{JournalDelete, SynchronousExtra, 5, 0},
+		{JournalWAL, SynchronousDefault, 1, 1},
+		{JournalWAL, SynchronousOff, 0, 0},
+		// the log is synced by the checkpoint rather than the commit
+		{JournalWAL, SynchronousNormal, 0, 2},
+		{JournalWAL, SynchronousFull, 1, 1},
+		{JournalWAL, SynchronousExtra, 1, 1},
+	}
+	for _, c := range cases {
+		cleanup()
+		table, err := OpenDB(Options{DBPath: "db.sqlite", JournalMode: c.mode, Synchronous: c.level})
+		assert.Nil(t, err)
+		for i := int32(0); i < 100; i++ {
+			assert.Nil(t, table.InsertRow(paddedRow(i)))
+		}
+		assert.Nil(t, table.Checkpoint())
+		syncs := table.Pager.Stats().Syncs
+		assert.Nil(t, table.Update(1, paddedRow(1)))
+		assert.Nil(t, table.Pager.Flush())
+		assert.Equal(t, c.commitSyncs, table.Pager.Stats().Syncs-syncs, "%v %v", c.mode, c.level)
+		syncs = table.Pager.Stats().Syncs
+		assert.Nil(t, table.Pager.Checkpoint())
+		assert.Equal(t, c.checkpointSyncs, table.Pager.Stats().Syncs-syncs, "%v %v", c.mode, c.level)
+		assert.Nil(t, table.Close())
+	}
+	cleanup()
+
+	// PRAGMA synchronous changes the level of an open database
+	table, err := OpenDB(Options{DBPath: "db.sqlite"})
+	assert.Nil(t, err)
+	defer cleanup()
+	assert.Equal(t, SynchronousFull, table.Pager.Synchronous)
+	for _, sql := range []string{"pragma synchronous = off", "insert 1 john john@example.com", "pragma synchronous"} {
+		s, err := PrepareStatement(sql)
+		assert.Nil(t, err, sql)
+		assert.Nil(t, ExecuteStatement(table, *s), sql)
+	}
+	assert.Equal(t, SynchronousOff, table.Pager.Synchronous)
+	assert.Equal(t, int64(0), table.Pager.Stats().Syncs)
+	assert.Nil(t, table.Close())
+}
+
+func TestMemVFS(t *testing.T) {
+	cleanup()
+	for _, mode := range []JournalMode{JournalDelete, JournalWAL} {
+		opts := Options{DBPath: "db.sqlite", JournalMode: mode, VFS: NewMemVFS()}
+		table, err := OpenDB(opts)
+		assert.Nil(t, err)
+		for i := int32(0); i < 200; i++ {
+			assert.Nil(t, table.InsertRow(paddedRow(i)))
+		}
+		_, err = table.DeleteRange(0, 99)
+		assert.Nil(t, err)
+		assert.Nil(t, table.Vacuum())
+		assert.Nil(t, table.Close())
+		_, err = os.Stat("db.sqlite")
+		assert.True(t, os.IsNotExist(err))
+
+		table, err = OpenDB(opts)
+		assert.Nil(t, err)
+		checkTree(t, table)
+		rows, err := table.SelectAll()
+		assert.Nil(t, err)
+		assert.Len(t, rows, 100)
+		assert.Equal(t, int32(0), table.Pager.Stats().FreePageCount)
+		assert.Nil(t, table.Close())
+	}
+
+	vfs := NewMemVFS()
+	handles := make([]File, 3)
+	for i := range handles {
+		var err error
+		handles[i], err = vfs.Open("db.sqlite", true)
+		assert.Nil(t, err)
+	}
+	a, b, c := handles[0], handles[1], handles[2]
+	assert.Nil(t, a.Lock(LockShared))
+	assert.Nil(t, b.Lock(LockShared))
+	assert.Nil(t, a.Lock(LockReserved))
+	assert.Equal(t, DBError{Busy}, b.Lock(LockReserved))
+	// the reader b keeps a from writing, and a keeps new readers out
+	assert.Equal(t, DBError{Busy}, a.Lock(LockExclusive))
+	assert.Equal(t, DBError{Busy}, c.Lock(LockShared))
+	assert.Nil(t, b.Unlock(LockNone))
+	assert.Nil(t, a.Lock(LockExclusive))
+	assert.Nil(t, a.Unlock(LockShared))
+	assert.Nil(t, c.Lock(LockShared))
+	assert.Nil(t, c.Lock(LockReserved))
+	for _, h := range handles {
+		assert.Nil(t, h.Close())
+	}
+	_, err := vfs.Open("missing", false)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMemoryDB(t *testing.T) {
+	for _, mode := range []JournalMode{JournalDelete, JournalWAL} {
+		// the pages live in the cache, however small, and the VFS is not
+		// used
+		vfs := NewMemVFS()
+		opts := Options{DBPath: MemoryDBPath, JournalMode: mode, CacheSize: 4, VFS: vfs}
+		table, err := OpenDB(opts)
+		assert.Nil(t, err)
+		other, err := OpenDB(opts)
+		assert.Nil(t, err)
+		for i := int32(0); i < 300; i++ {
+			assert.Nil(t, table.InsertRow(paddedRow(i)))
+		}
+		tx, err := table.Begin()
+		assert.Nil(t, err)
+		_, err = table.DeleteRange(0, 199)
+		assert.Nil(t, err)
+		assert.Nil(t, tx.Rollback())
+		_, err = table.DeleteRange(0, 99)
+		assert.Nil(t, err)
+		assert.Nil(t, table.Vacuum())
+		checkTree(t, table)
+		rows, err := table.SelectAll()
+		assert.Nil(t, err)
+		assert.Len(t, rows, 200)
+		tx, err = table.Begin()
+		assert.Nil(t, err)
+		for i := int32(1000); i < 1100; i++ {
+			assert.Nil(t, table.InsertRow(paddedRow(i)))
+		}
+		assert.Nil(t, table.Delete(150))
+		assert.Nil(t, tx.Rollback())
+		checkTree(t, table)
+		rows, err = table.SelectAll()
+		assert.Nil(t, err)
+		assert.Len(t, rows, 200)
+		assert.EqualValues(t, 0, table.Pager.Stats().PagesWritten)
+		exists, err := vfs.Exists(MemoryDBPath)
+		assert.Nil(t, err)
+		assert.False(t, exists)
+
+		// every open is a database of its own
+		rows, err = other.SelectAll()
+		assert.Nil(t, err)
+		assert.Len(t, rows, 0)
+		assert.Nil(t, other.Close())
+		assert.Nil(t, table.Close())
+		_, err = os.Stat(MemoryDBPath)
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestLocking(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	vfss := []VFS{NewMemVFS()}
+	if runtime.GOOS == "linux" {
+		// elsewhere the locks of a process do not exclude each other
+		vfss = append(vfss, OSVFS{})
+	}
+	for _, vfs := range vfss {
+		for _, mode := range []JournalMode{JournalDelete, JournalWAL} {
+			opts := Options{DBPath: "db.sqlite", JournalMode: mode, VFS: vfs}
+			a, err := OpenDB(opts)
+			assert.Nil(t, err)
+			b, err := OpenDB(opts)
+			assert.Nil(t, err)
+			count := func(table *Table) int {
+				rows, err := table.SelectAll()
+				assert.Nil(t, err)
+				return len(rows)
+			}
+
+			// a connection sees the commits of the other one
+			for i := int32(0); i < 300; i++ {
+				assert.Nil(t, a.InsertRow(paddedRow(i)))
+			}
+			assert.Nil(t, a.Pager.Flush())
+			assert.Equal(t, 300, count(b))
+			checkTree(t, b)
+
+			// a single writer at a time
+			assert.Nil(t, b.Pager.Flush())
+			assert.Nil(t, a.Delete(0))
+			assert.Equal(t, DBError{Busy}, b.InsertRow(paddedRow(1000)))
+			assert.Nil(t, b.Pager.Rollback())
+			assert.Nil(t, a.Pager.Flush())
+			assert.Nil(t, b.InsertRow(paddedRow(1000)))
+			assert.Nil(t, b.Pager.Flush())
+			assert.Equal(t, 300, count(a))
+
+			// a reader keeps the database file from being written, in WAL
+			// mode it keeps reading the database as of its first read
+			tx, err := b.Begin()
+			assert.Nil(t, err)
+			assert.Equal(t, 300, count(b))
+			assert.Nil(t, a.Pager.Flush())
+			assert.Nil(t, a.Delete(1))
+			if mode == JournalWAL {
+				assert.Nil(t, a.Pager.Flush())
+				assert.Equal(t, 300, count(b))
+				assert.Equal(t, DBError{Busy}, a.Checkpoint())
+			} else {
+				assert.Equal(t, DBError{Busy}, a.Pager.Flush())
+			}
+			assert.Nil(t, tx.Commit())
+			assert.Nil(t, a.Checkpoint())
+			assert.Equal(t, 299, count(b))
+			assert.Nil(t, b.Pager.Flush())
+
+			// a writer waits for the busy timeout
+			assert.Nil(t, a.Delete(2))
+			b.Pager.BusyTimeout = time.Second
+			done := make(chan error)
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				done <- a.Pager.Flush()
+			}()
+			assert.Nil(t, b.Delete(3))
+			assert.Nil(t, <-done)
+			assert.Nil(t, b.Pager.Flush())
+			assert.Equal(t, 297, count(a))
+			assert.Nil(t, a.Pager.Flush())
+
+			// the WAL is removed by the last connection to close it
+			assert.Nil(t, a.Close())
+			exists, err := vfs.Exists(walPath(opts.DBPath))
+			assert.Nil(t, err)
+			assert.Equal(t, mode == JournalWAL, exists)
+			assert.Equal(t, 297, count(b))
+			checkTree(t, b)
+			assert.Nil(t, b.Close())
+			exists, err = vfs.Exists(walPath(opts.DBPath))
+			assert.Nil(t, err)
+			assert.False(t, exists)
+			assert.Nil(t, vfs.Delete(opts.DBPath))
+		}
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	// rows whose email overflows are read through their overflow chain
+	row := func(id int32) Row {
+		row := paddedRow(id)
+		if id%3 == 0 {
+			copy(row.Email[:], bytes.Repeat([]byte{'o'}, len(row.Email)))
+		}
+		return row
+	}
+	const writers, readers, rowsPerWriter = 4, 4, 300
+	for _, mode := range []JournalMode{JournalDelete, JournalWAL} {
+		// a small cache makes the readers evict pages
+		table, err := OpenDB(Options{DBPath: "db.sqlite", VFS: NewMemVFS(), JournalMode: mode, CacheSize: 8, WALAutoCheckpoint: 50})
+		assert.Nil(t, err)
+		var writing, reading sync.WaitGroup
+		done := make(chan struct{})
+		for w := 0; w < writers; w++ {
+			writing.Add(1)
+			go func(w int32) {
+				defer writing.Done()
+				for i := int32(0); i < rowsPerWriter; i++ {
+					id := i*writers + w
+					assert.Nil(t, table.InsertRow(row(id)))
+					if i%10 == 0 {
+						assert.Nil(t, table.Flush())
+					}
+					if i%7 == 0 {
+						assert.Nil(t, table.Update(id, row(id)))
+					}
+					if i%5 == 0 {
+						assert.Nil(t, table.Delete(id))
+						assert.Nil(t, table.InsertRow(row(id)))
+					}
+				}
+			}(int32(w))
+		}
+		for r := 0; r < readers; r++ {
+			reading.Add(1)
+			go func(r int32) {
+				defer reading.Done()
+				for {
+					select {
+					case <-done:
+						return
+					case <-time.After(time.Millisecond):
+					}
+					rows, err := table.SelectRange(r*50, r*50+100)
+					assert.Nil(t, err)
+					for i, got := range rows {
+						assert.Equal(t, row(got.ID), got)
+						if i > 0 {
+							assert.Less(t, rows[i-1].ID, got.ID)
+						}
+					}
+					got, err := table.Find(r)
+					if err == nil {
+						assert.Equal(t, row(r), *got)
+					} else {
+						assert.Equal(t, DBError{RowNotFound}, err)
+					}
+				}
+			}(int32(r))
+		}
+		writing.Wait()
+		close(done)
+		reading.Wait()
+		assert.Nil(t, table.Checkpoint())
+		checkTree(t, table)
+		rows, err := table.SelectAll()
+		assert.Nil(t, err)
+		assert.Len(t, rows, writers*rowsPerWriter)
+		assert.Nil(t, table.Close())
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	for _, mode := range []JournalMode{JournalDelete, JournalWAL} {
+		// a small cache makes the writer evict the pages the snapshots read
+		table, err := OpenDB(Options{DBPath: "db.sqlite", VFS: NewMemVFS(), JournalMode: mode, CacheSize: 8})
+		assert.Nil(t, err)
+		var want []Row
+		for i := int32(0); i < 200; i++ {
+			row := paddedRow(i)
+			if i%3 == 0 {
+				copy(row.Email[:], bytes.Repeat([]byte{'o'}, len(row.Email)))
+			}
+			assert.Nil(t, table.InsertRow(row))
+			want = append(want, row)
+		}
+		assert.Nil(t, table.Flush())
+		snap, err := table.Snapshot()
+		assert.Nil(t, err)
+
+		// the writes made after a snapshot is taken, committed or not, are
+		// not seen by it, and do not wait for it
+		for i := int32(200); i < 400; i++ {
+			assert.Nil(t, table.InsertRow(paddedRow(i)))
+		}
+		_, err = table.DeleteRange(0, 150)
+		assert.Nil(t, err)
+		assert.Nil(t, table.Update(160, paddedRow(1160)))
+		assert.Nil(t, table.Flush())
+		assert.Equal(t, DBError{Busy}, table.Vacuum())
+		tx, err := table.Begin()
+		assert.Nil(t, err)
+		assert.Nil(t, tx.Savepoint("a"))
+		assert.Nil(t, table.Delete(170))
+		assert.Nil(t, tx.RollbackTo("a"))
+		assert.Nil(t, table.Delete(180))
+		inTx, err := table.Snapshot()
+		assert.Nil(t, err)
+		wantInTx, err := table.SelectAll()
+		assert.Nil(t, err)
+		_, err = table.DeleteRange(200, 300)
+		assert.Nil(t, err)
+		assert.Nil(t, tx.Rollback())
+
+		rows, err := snap.SelectAll()
+		assert.Nil(t, err)
+		assert.Equal(t, want, rows)
+		row, err := snap.Find(99)
+		assert.Nil(t, err)
+		assert.Equal(t, want[99], *row)
+		_, err = snap.Find(300)
+		assert.Equal(t, DBError{RowNotFound}, err)
+		rows, err = inTx.SelectAll()
+		assert.Nil(t, err)
+		assert.Equal(t, wantInTx, rows)
+		assert.Len(t, rows, 248)
+
+		// the page images are dropped with the last snapshot
+		assert.Nil(t, snap.Close())
+		assert.NotEmpty(t, table.Pager.versions)
+		assert.Nil(t, inTx.Close())
+		assert.Empty(t, table.Pager.versions)
+		_, err = snap.SelectAll()
+		assert.Equal(t, DBError{SnapshotClosed}, err)
+		rows, err = table.SelectAll()
+		assert.Nil(t, err)
+		assert.Len(t, rows, 249)
+		checkTree(t, table)
+		assert.Nil(t, table.Close())
+	}
+
+	// in WAL mode the commits of other connections are not seen either
+	opts := Options{DBPath: "db.sqlite", JournalMode: JournalWAL, VFS: NewMemVFS()}
+	a, err := OpenDB(opts)
+	assert.Nil(t, err)
+	b, err := OpenDB(opts)
+	assert.Nil(t, err)
+	for i := int32(0); i < 100; i++ {
+		assert.Nil(t, a.InsertRow(paddedRow(i)))
+	}
+	assert.Nil(t, a.Flush())
+	snap, err := a.Snapshot()
+	assert.Nil(t, err)
+	for i := int32(100); i < 200; i++ {
+		assert.Nil(t, b.InsertRow(paddedRow(i)))
+	}
+	_, err = b.DeleteRange(0, 50)
+	assert.Nil(t, err)
+	assert.Nil(t, b.Flush())
+	assert.Nil(t, a.InsertRow(paddedRow(500)))
+	assert.Nil(t, a.Flush())
+	rows, err := snap.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, 100)
+	assert.Equal(t, paddedRow(0), rows[0])
+	assert.Nil(t, snap.Close())
+	rows, err = a.SelectAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, 150)
+	assert.Nil(t, a.Close())
+	assert.Nil(t, b.Close())
+}
+
+func TestConcurrentSnapshots(t *testing.T) {
+	const rows = 1000
+	for _, mode := range []JournalMode{JournalDelete, JournalWAL} {
+		table, err := OpenDB(Options{DBPath: "db.sqlite", VFS: NewMemVFS(), JournalMode: mode, CacheSize: 8, WALAutoCheckpoint: 50})
+		assert.Nil(t, err)
+		var reading sync.WaitGroup
+		done := make(chan struct{})
+		for r := 0; r < 4; r++ {
+			reading.Add(1)
+			go func() {
+				defer reading.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					snap, err := table.Snapshot()
+					assert.Nil(t, err)
+					first, err := snap.SelectAll()
+					assert.Nil(t, err)
+					// the keys are inserted in order, a snapshot sees the
+					// first ones and the same ones for as long as it is open
+					for i, row := range first {
+						assert.Equal(t, paddedRow(int32(i)), row)
+					}
+					time.Sleep(time.Millisecond)
+					again, err := snap.SelectAll()
+					assert.Nil(t, err)
+					assert.Equal(t, first, again)
+					assert.Nil(t, snap.Close())
+				}
+			}()
+		}
+		for i := int32(0); i < rows; i++ {
+			assert.Nil(t, table.InsertRow(paddedRow(i)))
+			if i%10 == 0 {
+				assert.Nil(t, table.Flush())
+			}
+		}
+		close(done)
+		reading.Wait()
+		assert.Empty(t, table.Pager.versions)
+		all, err := table.SelectAll()
+		assert.Nil(t, err)
+		assert.Len(t, all, rows)
+		checkTree(t, table)
+		assert.Nil(t, table.Close())
+	}
+}
+
+// checkTree verifies the B+tree invariants: keys are sorted and within the
+// bounds given by the parent, parent pointers are right, all leaves are at
+// the same depth and chained in key order. It returns the tree depth.
+func checkTree(t *testing.T, table *Table) int {
+	var leaves []int32
+	depth := -1
+	var walk func(pageNum, parent int32, low, high int64, level int) int64
+	walk = func(pageNum, parent int32, low, high int64, level int) int64 {
+		page, err := table.Pager.GetPage(pageNum, false)
+		if !assert.Nil(t, err) || !assert.NotNil(t, page) {
+			return low
+		}
+		defer table.Pager.Unpin(page)
+		assert.Equal(t, pageNum == table.RootPageNum, page.RootNode)
+		if pageNum != table.RootPageNum {
+			assert.Equal(t, parent, page.ParentNode, "parent of page %d", pageNum)
+		}
+		if page.NodeType == Leaf {
+			if depth == -1 {
+				depth = level
+			}
+			assert.Equal(t, depth, level, "depth of leaf %d", pageNum)
+			leaves = append(leaves, pageNum)
+			for i := int32(0); i < page.NumCells; i++ {
+				key := page.CellKey(i)
+				assert.Greater(t, int64(key), low)
+				assert.LessOrEqual(t, int64(key), high)
+				low = int64(key)
+			}
+			assert.Equal(t, LeafBodySize-cellsSize(page.leafCells()), page.freeSpace(), "free space of leaf %d", pageNum)
+			return low
+		}
+		assert.Greater(t, page.ChildrenNum, int32(0))
+		for _, child := range page.Children[:page.ChildrenNum] {
+			assert.LessOrEqual(t, int64(child.Key), high)
+			walk(child.PageNum, pageNum, low, int64(child.Key), level+1)
+			low = int64(child.Key)
+		}
+		return walk(page.RightmostChild, pageNum, low, high, level+1)
+	}
+	walk(table.RootPageNum, 0, math.MinInt64, math.MaxInt64, 1)
+	for i, pageNum := range leaves {
+		page, err := table.Pager.GetPage(pageNum, false)
+		assert.Nil(t, err)
+		if i+1 < len(leaves) {
+			assert.Equal(t, leaves[i+1], page.Sibling)
+		} else {
+			assert.EqualValues(t, 0, page.Sibling)
+		}
+		table.Pager.Unpin(page)
+	}
+	return depth
+}
+
+// paddedRow returns a row with a long email, so that a leaf holds about as
+// many of them as it held fixed-size rows.
+func paddedRow(id int32) Row {
+	row := Row{ID: id}
+	copy(row.Name[:], fmt.Sprintf("name-%d", id))
+	copy(row.Email[:], bytes.Repeat([]byte{'e'}, 200))
+	return row
+}
+
+func searchRow(t *testing.T, table *Table, key int32) Row {
+	cursor, err := table.Search(key)
+	assert.Nil(t, err)
+	row, err := table.GetRowByCursor(cursor, false)
+	assert.Nil(t, err)
+	return *row
+}
+
+func writeFile(t *testing.T, bs []byte) {
+	err := os.WriteFile("db.sqlite", bs, 0666)
+	assert.Nil(t, err)
+}
+
+// corruptByte flips the bits of the byte at offset in page pageNum of the
+// database file.
+func corruptByte(t *testing.T, opts Options, pageNum int32, offset int) {
+	file, err := opts.VFS.Open(opts.DBPath, false)
+	assert.Nil(t, err)
+	b := make([]byte, 1)
+	off := int64(PageSize)*int64(pageNum) + int64(offset)
+	_, err = file.ReadAt(b, off)
+	assert.Nil(t, err)
+	b[0] ^= 0xff
+	_, err = file.WriteAt(b, off)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+}
+
+func cleanup() {
+	for _, path := range []string{"db.sqlite", "db.sqlite-vacuum"} {
+		os.Remove(path)
+		os.Remove(journalPath(path))
+		os.Remove(walPath(path))
+	}
+}
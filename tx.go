@@ -0,0 +1,114 @@
+package main
+
+// Tx is an explicit transaction: the changes made to its table until Commit
+// or Rollback are persisted or discarded together. Outside a Tx the changes
+// are committed by the next Flush or Close. The transaction is the one of the
+// whole table, the changes other goroutines make meanwhile are part of it.
+type Tx struct {
+	table *Table
+	// implicit is set for a transaction started by a SAVEPOINT, it commits
+	// when its outermost savepoint is released.
+	implicit bool
+}
+
+// Begin commits the pending changes of table and starts a transaction.
+func (table *Table) Begin() (*Tx, error) {
+	table.lock()
+	defer table.unlock()
+	return table.begin()
+}
+
+func (table *Table) begin() (*Tx, error) {
+	if table.tx != nil {
+		return nil, DBError{TransactionActive}
+	}
+	err := table.Pager.Flush()
+	if err != nil {
+		return nil, err
+	}
+	table.tx = &Tx{table: table}
+	return table.tx, nil
+}
+
+// Commit persists the changes of the transaction.
+func (tx *Tx) Commit() error {
+	tx.table.lock()
+	defer tx.table.unlock()
+	return tx.commit()
+}
+
+func (tx *Tx) commit() error {
+	if tx.table.tx != tx {
+		return DBError{NoTransaction}
+	}
+	err := tx.table.Pager.Flush()
+	if err != nil {
+		return err
+	}
+	tx.table.tx = nil
+	tx.table.Pager.savepoints = nil
+	return nil
+}
+
+// Rollback discards the changes of the transaction.
+func (tx *Tx) Rollback() error {
+	tx.table.lock()
+	defer tx.table.unlock()
+	return tx.rollback()
+}
+
+func (tx *Tx) rollback() error {
+	if tx.table.tx != tx {
+		return DBError{NoTransaction}
+	}
+	tx.table.tx = nil
+	return tx.table.Pager.Rollback()
+}
+
+// Rollback discards every change since the last commit: the cache is dropped,
+// the pages already written are restored from the journal, or forgotten from
+// the WAL, and the header is read again, or for an in-memory database the
+// images of the pages as of the last commit are put back. It ends the
+// transaction, releasing the locks on the database file.
+func (pager *Pager) Rollback() error {
+	err := pager.preserveTransaction()
+	if err != nil {
+		return err
+	}
+	if pager.journal != nil {
+		err := pager.replayJournal(pager.journal, pager.journalHeader)
+		if err != nil {
+			return err
+		}
+		pager.journal.Close()
+		pager.journal = nil
+		pager.journaled = nil
+		err = pager.vfs.Delete(pager.journalPath)
+		if err != nil {
+			return DBError{DBFileError}
+		}
+		err = pager.syncDir(pager.journalPath)
+		if err != nil {
+			return err
+		}
+	}
+	if pager.wal != nil {
+		pager.wal.rollback()
+	}
+	pager.savepoints = nil
+	if pager.memory != nil {
+		pager.rollbackMemory()
+		return pager.endTransaction()
+	}
+	if pager.lockLevel == LockNone {
+		// nothing was read or changed
+		return nil
+	}
+	pager.loaded = false
+	err = pager.validateCache()
+	unlockErr := pager.endTransaction()
+	if err == nil {
+		err = unlockErr
+	}
+	return err
+}
@@ -0,0 +1,254 @@
+package main
+
+import "math"
+
+// Vacuum rebuilds the database into a new file holding the rows in densely
+// packed pages without any free page, then replaces the original file with
+// it. It cannot run inside a transaction nor while snapshots are open. It
+// waits for the other connections to leave the database, they must be
+// reopened after it as they keep the original file.
+func (table *Table) Vacuum() error {
+	table.lock()
+	defer table.unlock()
+	return table.vacuum()
+}
+
+func (table *Table) vacuum() error {
+	if table.tx != nil {
+		return DBError{TransactionActive}
+	}
+	if len(table.Pager.snapshots) > 0 {
+		return DBError{Busy}
+	}
+	err := table.Pager.Flush()
+	if err != nil {
+		return err
+	}
+	err = table.Pager.beginWrite()
+	if err == nil {
+		err = table.Pager.lock(LockExclusive)
+	}
+	if err != nil {
+		table.Pager.endTransaction()
+		return err
+	}
+	size, err := table.cellsSize()
+	if err != nil {
+		table.Pager.endTransaction()
+		return err
+	}
+	if table.Pager.memory != nil {
+		return table.vacuumMemory(size)
+	}
+	opts := table.options
+	opts.DBPath = table.options.DBPath + "-vacuum"
+	vfs := opts.vfs()
+	vfs.Delete(opts.DBPath)
+	pager, err := OpenPager(opts)
+	if err != nil {
+		table.Pager.endTransaction()
+		return err
+	}
+	dst := &Table{
+		Pager:       pager,
+		RootPageNum: RootPageNum,
+	}
+	err = table.copyRows(dst, size)
+	if err == nil {
+		err = pager.Close()
+	} else {
+		pager.File.Close()
+		if pager.wal != nil {
+			pager.wal.File.Close()
+			vfs.Delete(pager.wal.path)
+		}
+	}
+	if err != nil {
+		vfs.Delete(opts.DBPath)
+		table.Pager.endTransaction()
+		return err
+	}
+	// the WAL, if any, is emptied so that none is left for the new file, and
+	// the file is replaced under the exclusive lock, which the original file
+	// keeps until the new one is open
+	if table.Pager.wal != nil {
+		err = table.Pager.checkpoint()
+	}
+	if err == nil {
+		err = vfs.Rename(opts.DBPath, table.options.DBPath)
+		if err != nil {
+			vfs.Delete(opts.DBPath)
+			err = DBError{DBFileError}
+		}
+	}
+	if err == nil {
+		pager, err = OpenPager(table.options)
+	}
+	if err != nil {
+		// the table keeps the original file
+		table.Pager.endTransaction()
+		return err
+	}
+	old := table.Pager
+	table.Pager = pager
+	err = old.Close()
+	if err != nil {
+		return err
+	}
+	return pager.syncDir(table.options.DBPath)
+}
+
+// vacuumMemory rebuilds an in-memory database into a new pager, which then
+// replaces the original one.
+func (table *Table) vacuumMemory(size int32) error {
+	pager, err := OpenPager(table.options)
+	if err == nil {
+		err = table.copyRows(&Table{Pager: pager, RootPageNum: RootPageNum}, size)
+		if err == nil {
+			err = pager.Flush()
+		}
+		if err != nil {
+			pager.File.Close()
+		}
+	}
+	if err != nil {
+		table.Pager.endTransaction()
+		return err
+	}
+	old := table.Pager
+	table.Pager = pager
+	return old.Close()
+}
+
+// cellsSize returns the room the rows of table take in leaf pages.
+func (table *Table) cellsSize() (int32, error) {
+	size := int32(0)
+	cursor, err := table.seek(math.MinInt32)
+	if err != nil {
+		return 0, err
+	}
+	for !cursor.EndOfTable {
+		row, err := table.getRowByCursor(&cursor, false)
+		if err != nil {
+			return 0, err
+		}
+		size += payloadCellSize(int32(len(row.Payload()))) + CellPointerSize
+		err = cursor.advance()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// copyRows fills the empty table dst with the rows of table, whose cells take
+// size bytes. Leaves are filled in key order, the last one sharing its cells
+// with the one before if it is left less than MinLeafFill full, then every
+// level of internal nodes is built on top of the one below until a single
+// node is left, which goes into the root page.
+func (table *Table) copyRows(dst *Table, size int32) error {
+	cursor, err := table.seek(math.MinInt32)
+	if err != nil {
+		return err
+	}
+	if size <= LeafBodySize {
+		root, err := dst.Pager.GetPage(RootPageNum, false)
+		if err != nil {
+			return err
+		}
+		defer dst.Pager.Unpin(root)
+		dst.Pager.MarkDirty(root)
+		return table.copyLeaf(&cursor, dst.Pager, root)
+	}
+	var level []Child
+	var prev, leaf *Page
+	defer func() {
+		dst.Pager.Unpin(prev)
+		dst.Pager.Unpin(leaf)
+	}()
+	for !cursor.EndOfTable {
+		dst.Pager.Unpin(prev)
+		prev = leaf
+		leaf, err = dst.Pager.AllocatePage()
+		if err != nil {
+			return err
+		}
+		if prev != nil {
+			prev.Sibling = leaf.PageNum
+		}
+		err = table.copyLeaf(&cursor, dst.Pager, leaf)
+		if err != nil {
+			return err
+		}
+		level = append(level, Child{Key: leaf.CellKey(leaf.NumCells - 1), PageNum: leaf.PageNum})
+	}
+	if leaf.usedSize() < MinLeafFill {
+		level[len(level)-2].Key = leafNodeRedistribute(prev, leaf)
+	}
+	for {
+		nodeCount := (len(level) + int(ChildrenPerPage)) / int(ChildrenPerPage+1)
+		if nodeCount == 1 {
+			return dst.fillInternalNode(RootPageNum, level)
+		}
+		next := make([]Child, 0, nodeCount)
+		start := 0
+		for i := 0; i < nodeCount; i++ {
+			n := len(level) / nodeCount
+			if i < len(level)%nodeCount {
+				n++
+			}
+			node, err := dst.Pager.AllocatePage()
+			if err != nil {
+				return err
+			}
+			pageNum := node.PageNum
+			dst.Pager.Unpin(node)
+			err = dst.fillInternalNode(pageNum, level[start:start+n])
+			if err != nil {
+				return err
+			}
+			next = append(next, Child{Key: level[start+n-1].Key, PageNum: pageNum})
+			start += n
+		}
+		level = next
+	}
+}
+
+// copyLeaf copies rows from cursor into the empty leaf page of pager until it
+// is full or the table ends.
+func (table *Table) copyLeaf(cursor *Cursor, pager *Pager, page *Page) error {
+	for !cursor.EndOfTable {
+		row, err := table.getRowByCursor(cursor, false)
+		if err != nil {
+			return err
+		}
+		if page.freeSpace() < payloadCellSize(int32(len(row.Payload())))+CellPointerSize {
+			return nil
+		}
+		cell, err := pager.NewCell(*row)
+		if err != nil {
+			return err
+		}
+		page.insertCell(page.NumCells, cell.encode())
+		err = cursor.advance()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillInternalNode turns page pageNum into an internal node over children.
+func (table *Table) fillInternalNode(pageNum int32, children []Child) error {
+	page, err := table.Pager.GetPage(pageNum, false)
+	if err != nil {
+		return err
+	}
+	defer table.Pager.Unpin(page)
+	table.Pager.MarkDirty(page)
+	rootNode := page.RootNode
+	page.reset(Internal)
+	page.RootNode = rootNode
+	page.setChildList(children)
+	return table.setParent(children, pageNum)
+}
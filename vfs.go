@@ -0,0 +1,381 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The pager does all its I/O through a VFS, chosen by Options.VFS, so that a
+// database can live in the operating system's file system, in memory or on
+// any storage a VFS is written for.
+
+// VFS opens, deletes and renames the files of a database: the database file
+// itself, its journal and its WAL.
+type VFS interface {
+	// Open opens the file at path for reading and writing, creating it if
+	// create is set. The error satisfies os.IsNotExist if the file does not
+	// exist and create is not set.
+	Open(path string, create bool) (File, error)
+	Delete(path string) error
+	Rename(oldPath, newPath string) error
+	Exists(path string) (bool, error)
+	// SyncDir makes the creation, deletion or renaming of path durable.
+	SyncDir(path string) error
+}
+
+// File is an open database, journal or WAL file.
+type File interface {
+	ReadAt(p []byte, off int64) (int, error)
+	WriteAt(p []byte, off int64) (int, error)
+	Truncate(size int64) error
+	// Sync makes the writes done so far durable.
+	Sync() error
+	Size() (int64, error)
+	// Lock raises the lock held on the file through this handle to level,
+	// Unlock lowers it to level. A lock that conflicts with the locks of
+	// other handles is not granted, Lock returns a Busy error then. Raising
+	// a lock past LockReserved takes LockReserved first.
+	Lock(level LockLevel) error
+	Unlock(level LockLevel) error
+	Close() error
+}
+
+// LockLevel is the lock held on a database file, as in SQLite: readers hold
+// a shared lock, a writer a reserved lock until it needs to write the file,
+// which takes an exclusive lock. A pending lock is held while waiting for the
+// readers to leave, it keeps new readers out.
+type LockLevel int
+
+const (
+	LockNone LockLevel = iota
+	LockShared
+	LockReserved
+	LockPending
+	LockExclusive
+)
+
+// The locks of the OS files are taken on bytes far past the pages a
+// database uses, as in SQLite: readers share a read lock on a range of
+// sharedSize bytes, which an exclusive lock write locks whole.
+const (
+	pendingByte  = int64(0x40000000)
+	reservedByte = pendingByte + 1
+	sharedFirst  = pendingByte + 2
+	sharedSize   = 510
+)
+
+// vfs returns the VFS of opts, the operating system's by default.
+func (opts Options) vfs() VFS {
+	if opts.VFS == nil {
+		return OSVFS{}
+	}
+	return opts.VFS
+}
+
+// OSVFS is the operating system's file system.
+type OSVFS struct{}
+
+type osFile struct {
+	*os.File
+	level LockLevel
+}
+
+func (f *osFile) Size() (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (f *osFile) Lock(level LockLevel) error {
+	if level <= f.level {
+		return nil
+	}
+	if f.level == LockNone {
+		// a writer waiting for an exclusive lock holds the pending byte,
+		// which keeps new readers out
+		err := f.setLock(lockRead, pendingByte, 1)
+		if err != nil {
+			return err
+		}
+		err = f.setLock(lockRead, sharedFirst, sharedSize)
+		f.setLock(lockUnlock, pendingByte, 1)
+		if err != nil {
+			return err
+		}
+		f.level = LockShared
+	}
+	if level >= LockReserved && f.level < LockReserved {
+		err := f.setLock(lockWrite, reservedByte, 1)
+		if err != nil {
+			return err
+		}
+		f.level = LockReserved
+	}
+	if level >= LockPending && f.level < LockPending {
+		err := f.setLock(lockWrite, pendingByte, 1)
+		if err != nil {
+			return err
+		}
+		f.level = LockPending
+	}
+	if level == LockExclusive {
+		err := f.setLock(lockWrite, sharedFirst, sharedSize)
+		if err != nil {
+			return err
+		}
+		f.level = LockExclusive
+	}
+	return nil
+}
+
+func (f *osFile) Unlock(level LockLevel) error {
+	if level >= f.level {
+		return nil
+	}
+	if level == LockNone {
+		f.level = LockNone
+		return f.setLock(lockUnlock, 0, 0)
+	}
+	if f.level == LockExclusive {
+		err := f.setLock(lockRead, sharedFirst, sharedSize)
+		if err != nil {
+			return err
+		}
+	}
+	if level < LockPending && f.level >= LockPending {
+		err := f.setLock(lockUnlock, pendingByte, 1)
+		if err != nil {
+			return err
+		}
+	}
+	if level < LockReserved && f.level >= LockReserved {
+		err := f.setLock(lockUnlock, reservedByte, 1)
+		if err != nil {
+			return err
+		}
+	}
+	f.level = level
+	return nil
+}
+
+func (OSVFS) Open(path string, create bool) (File, error) {
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+	}
+	file, err := os.OpenFile(path, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &osFile{File: file}, nil
+}
+
+func (OSVFS) Delete(path string) error {
+	return os.Remove(path)
+}
+
+func (OSVFS) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (OSVFS) Exists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (OSVFS) SyncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// MemVFS keeps files in memory, for as long as the MemVFS is referenced.
+// Every handle opened on a file sees the same content and takes part in its
+// locking.
+type MemVFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+type memFile struct {
+	data []byte
+	// shared counts the handles holding at least a shared lock, writer is
+	// the one holding a reserved, pending or exclusive lock, if any.
+	shared int
+	writer *memHandle
+}
+
+type memHandle struct {
+	vfs   *MemVFS
+	file  *memFile
+	level LockLevel
+}
+
+func NewMemVFS() *MemVFS {
+	return &MemVFS{files: make(map[string]*memFile)}
+}
+
+func (vfs *MemVFS) Open(path string, create bool) (File, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	file, ok := vfs.files[path]
+	if !ok {
+		if !create {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		}
+		file = &memFile{}
+		vfs.files[path] = file
+	}
+	return &memHandle{vfs: vfs, file: file}, nil
+}
+
+func (vfs *MemVFS) Delete(path string) error {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	if _, ok := vfs.files[path]; !ok {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	delete(vfs.files, path)
+	return nil
+}
+
+func (vfs *MemVFS) Rename(oldPath, newPath string) error {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	file, ok := vfs.files[oldPath]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: oldPath, Err: os.ErrNotExist}
+	}
+	delete(vfs.files, oldPath)
+	vfs.files[newPath] = file
+	return nil
+}
+
+func (vfs *MemVFS) Exists(path string) (bool, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	_, ok := vfs.files[path]
+	return ok, nil
+}
+
+func (vfs *MemVFS) SyncDir(path string) error {
+	return nil
+}
+
+func (h *memHandle) ReadAt(p []byte, off int64) (int, error) {
+	h.vfs.mu.Lock()
+	defer h.vfs.mu.Unlock()
+	data := h.file.data
+	if off >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *memHandle) WriteAt(p []byte, off int64) (int, error) {
+	h.vfs.mu.Lock()
+	defer h.vfs.mu.Unlock()
+	h.file.resize(off + int64(len(p)))
+	copy(h.file.data[off:], p)
+	return len(p), nil
+}
+
+// resize grows the file to size bytes if it is smaller.
+func (file *memFile) resize(size int64) {
+	if size > int64(len(file.data)) {
+		file.data = append(file.data, make([]byte, size-int64(len(file.data)))...)
+	}
+}
+
+func (h *memHandle) Truncate(size int64) error {
+	h.vfs.mu.Lock()
+	defer h.vfs.mu.Unlock()
+	if size < int64(len(h.file.data)) {
+		h.file.data = h.file.data[:size:size]
+	}
+	h.file.resize(size)
+	return nil
+}
+
+func (h *memHandle) Sync() error {
+	return nil
+}
+
+func (h *memHandle) Size() (int64, error) {
+	h.vfs.mu.Lock()
+	defer h.vfs.mu.Unlock()
+	return int64(len(h.file.data)), nil
+}
+
+func (h *memHandle) Lock(level LockLevel) error {
+	h.vfs.mu.Lock()
+	defer h.vfs.mu.Unlock()
+	if level <= h.level {
+		return nil
+	}
+	file := h.file
+	if h.level == LockNone {
+		if file.writer != nil && file.writer.level >= LockPending {
+			return DBError{Busy}
+		}
+		file.shared++
+		h.level = LockShared
+	}
+	if level == LockShared {
+		return nil
+	}
+	if file.writer != nil && file.writer != h {
+		return DBError{Busy}
+	}
+	file.writer = h
+	if level == LockReserved {
+		h.level = LockReserved
+		return nil
+	}
+	// the pending lock is kept if the readers do not let the exclusive
+	// lock be granted, so that no new reader comes in meanwhile
+	h.level = LockPending
+	if level == LockExclusive && file.shared == 1 {
+		h.level = LockExclusive
+		return nil
+	}
+	if level == LockExclusive {
+		return DBError{Busy}
+	}
+	return nil
+}
+
+func (h *memHandle) Unlock(level LockLevel) error {
+	h.vfs.mu.Lock()
+	defer h.vfs.mu.Unlock()
+	if level >= h.level {
+		return nil
+	}
+	file := h.file
+	if level < LockReserved && file.writer == h {
+		file.writer = nil
+	}
+	if level == LockNone {
+		file.shared--
+	}
+	h.level = level
+	return nil
+}
+
+func (h *memHandle) Close() error {
+	return h.Unlock(LockNone)
+}
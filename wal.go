@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"sort"
+)
+
+// In WAL mode the database file is only written by checkpoints. Pages are
+// appended to the write-ahead log as frames instead, the last frame of a
+// transaction, the header page, being marked as a commit frame with the size
+// of the database. Each frame checksum covers the checksum of the frame
+// before it, so the valid frames of the log are the ones up to the first
+// frame that does not match, and only those up to the last commit frame among
+// them are committed. The WAL index tells, for every page in the log, where
+// its latest frame is.
+
+type JournalMode int
+
+const (
+	// JournalDelete uses a rollback journal deleted at commit.
+	JournalDelete JournalMode = iota
+	// JournalWAL uses a write-ahead log.
+	JournalWAL
+)
+
+const (
+	// DefaultWALAutoCheckpoint is the number of frames in the log above
+	// which a commit runs a checkpoint, when Options.WALAutoCheckpoint is
+	// not set.
+	DefaultWALAutoCheckpoint = 1000
+)
+
+var WALMagic = [8]byte{'g', 'o', 's', 'q', 'l', 'w', 'a', 'l'}
+
+type WALHeader struct {
+	Magic    [8]byte
+	PageSize uint32
+	// Salt changes at every checkpoint, so frames left from before it are
+	// not taken for new ones.
+	Salt uint32
+}
+
+type WALFrameHeader struct {
+	PageNum int32
+	// CommitSize is the page count of the database for a commit frame, 0
+	// for the other frames.
+	CommitSize int32
+	Salt       uint32
+	Checksum   uint32
+}
+
+var (
+	walHeaderSize      = int64(binary.Size(WALHeader{}))
+	walFrameHeaderSize = int64(binary.Size(WALFrameHeader{}))
+	walFrameSize       = walFrameHeaderSize + PageSize
+)
+
+type WAL struct {
+	File   File
+	path   string
+	header WALHeader
+	// size is the end of the last frame written, checksum its checksum.
+	size     int64
+	checksum uint32
+	// index has the offsets of the latest committed frame of each page,
+	// pending those of the frames written by the current transaction.
+	index   map[int32]int64
+	pending map[int32]int64
+	// commitSize is the page count of the database as of the last commit,
+	// 0 if the log holds no commit, commitEnd and commitChecksum the end and
+	// checksum of its commit frame.
+	commitSize     int32
+	commitEnd      int64
+	commitChecksum uint32
+	// AutoCheckpoint is the number of committed frames past which the log
+	// is checkpointed, never if not positive.
+	AutoCheckpoint int
+	Synchronous    Synchronous
+	// Syncs counts the fsyncs of the log.
+	Syncs int64
+}
+
+func walPath(dbPath string) string {
+	return dbPath + "-wal"
+}
+
+func walChecksum(prev uint32, header WALFrameHeader, data []byte) uint32 {
+	var prefix [16]byte
+	binary.BigEndian.PutUint32(prefix[:], prev)
+	binary.BigEndian.PutUint32(prefix[4:], uint32(header.PageNum))
+	binary.BigEndian.PutUint32(prefix[8:], uint32(header.CommitSize))
+	binary.BigEndian.PutUint32(prefix[12:], header.Salt)
+	return crc32.Update(crc32.ChecksumIEEE(prefix[:]), crc32.IEEETable, data)
+}
+
+// OpenWAL opens the log at path, creating it if needed, and indexes its
+// committed frames. It takes its settings from opts. A log without a valid
+// header is only overwritten by the first frame written.
+func OpenWAL(path string, opts Options) (*WAL, error) {
+	vfs := opts.vfs()
+	file, err := vfs.Open(path, true)
+	if err != nil {
+		return nil, DBError{DBFileError}
+	}
+	autoCheckpoint := opts.WALAutoCheckpoint
+	if autoCheckpoint == 0 {
+		autoCheckpoint = DefaultWALAutoCheckpoint
+	}
+	wal := &WAL{
+		File:           file,
+		path:           path,
+		AutoCheckpoint: autoCheckpoint,
+		Synchronous:    opts.Synchronous.resolve(),
+	}
+	wal.clear()
+	valid, err := wal.refresh()
+	if err == nil && !valid {
+		err = syncDir(vfs, path, wal.Synchronous, &wal.Syncs)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return wal, nil
+}
+
+// refresh catches up with the transactions committed to the log since it was
+// last read, by this connection or another one, and tells whether the log
+// has a valid header. A log emptied by a checkpoint, or whose header changed,
+// is indexed again from its start.
+func (wal *WAL) refresh() (bool, error) {
+	var header WALHeader
+	err := binary.Read(io.NewSectionReader(wal.File, 0, walHeaderSize), binary.BigEndian, &header)
+	if err != nil || header.Magic != WALMagic || header.PageSize != PageSize {
+		if wal.commitEnd != walHeaderSize {
+			wal.clear()
+		}
+		return false, nil
+	}
+	if header != wal.header {
+		wal.clear()
+		wal.header = header
+	}
+	return true, wal.recover()
+}
+
+// recover indexes the frames of the log from the end of the last commit
+// indexed up to its last valid commit frame, the frames after it are
+// overwritten by the next transaction. The index is copied before it is
+// changed, so that the previous one stays as it was.
+func (wal *WAL) recover() error {
+	frame := make([]byte, walFrameSize)
+	frames := make(map[int32]int64)
+	checksum := wal.commitChecksum
+	copied := false
+	for offset := wal.commitEnd; ; offset += walFrameSize {
+		_, err := wal.File.ReadAt(frame, offset)
+		if err != nil {
+			break
+		}
+		var header WALFrameHeader
+		err = binary.Read(bytes.NewReader(frame), binary.BigEndian, &header)
+		if err != nil {
+			return err
+		}
+		data := frame[walFrameHeaderSize:]
+		if header.Salt != wal.header.Salt || header.Checksum != walChecksum(checksum, header, data) {
+			break
+		}
+		checksum = header.Checksum
+		frames[header.PageNum] = offset
+		if header.CommitSize != 0 {
+			if !copied {
+				index := make(map[int32]int64, len(wal.index)+len(frames))
+				for pageNum, frameOffset := range wal.index {
+					index[pageNum] = frameOffset
+				}
+				wal.index = index
+				copied = true
+			}
+			for pageNum, frameOffset := range frames {
+				wal.index[pageNum] = frameOffset
+			}
+			frames = make(map[int32]int64)
+			wal.commitSize = header.CommitSize
+			wal.commitEnd = offset + walFrameSize
+			wal.commitChecksum = checksum
+		}
+	}
+	wal.size = wal.commitEnd
+	wal.checksum = wal.commitChecksum
+	return nil
+}
+
+// Frames returns the number of committed frames in the log.
+func (wal *WAL) Frames() int {
+	return int((wal.commitEnd - walHeaderSize) / walFrameSize)
+}
+
+// reset empties the log, with a new salt. The header is only written with
+// the first frame, so that the log is left empty, and consistent with the
+// state of wal, whichever of the file operations fails.
+func (wal *WAL) reset() error {
+	wal.clear()
+	return wal.File.Truncate(0)
+}
+
+// clear forgets the frames of the log, which is then written from its start
+// with a new salt.
+func (wal *WAL) clear() {
+	wal.header = WALHeader{
+		Magic:    WALMagic,
+		PageSize: PageSize,
+		Salt:     rand.Uint32(),
+	}
+	wal.size = walHeaderSize
+	wal.checksum = 0
+	wal.index = make(map[int32]int64)
+	wal.pending = make(map[int32]int64)
+	wal.commitSize = 0
+	wal.commitEnd = walHeaderSize
+	wal.commitChecksum = 0
+}
+
+// frameOffset returns the offset of the latest frame of page pageNum visible
+// to the current transaction, or 0 if the page is not in the log.
+func (wal *WAL) frameOffset(pageNum int32) int64 {
+	if offset, ok := wal.pending[pageNum]; ok {
+		return offset
+	}
+	return wal.index[pageNum]
+}
+
+func (wal *WAL) readPage(pageNum int32, bs []byte) (bool, error) {
+	offset := wal.frameOffset(pageNum)
+	if offset == 0 {
+		return false, nil
+	}
+	err := wal.readFrame(offset, bs)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// readFrame reads the page of the frame at offset.
+func (wal *WAL) readFrame(offset int64, bs []byte) error {
+	_, err := wal.File.ReadAt(bs[:PageSize], offset+walFrameHeaderSize)
+	return err
+}
+
+// appendFrame writes the frame of page pageNum at the end of the log.
+func (wal *WAL) appendFrame(pageNum int32, data []byte, commitSize int32) error {
+	header := WALFrameHeader{
+		PageNum:    pageNum,
+		CommitSize: commitSize,
+		Salt:       wal.header.Salt,
+	}
+	header.Checksum = walChecksum(wal.checksum, header, data)
+	buf := &bytes.Buffer{}
+	offset := wal.size
+	if offset == walHeaderSize {
+		err := binary.Write(buf, binary.BigEndian, wal.header)
+		if err != nil {
+			return err
+		}
+		offset = 0
+	}
+	err := binary.Write(buf, binary.BigEndian, header)
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+	_, err = wal.File.WriteAt(buf.Bytes(), offset)
+	if err != nil {
+		return err
+	}
+	wal.pending[pageNum] = wal.size
+	wal.size += walFrameSize
+	wal.checksum = header.Checksum
+	return nil
+}
+
+// commit appends the header page as the commit frame of the transaction and
+// syncs the log, which makes the transaction durable. In SynchronousNormal
+// the log is only synced by the next checkpoint.
+func (wal *WAL) commit(header []byte, commitSize int32) error {
+	err := wal.appendFrame(HeaderPageNum, header, commitSize)
+	if err != nil {
+		return err
+	}
+	if wal.Synchronous != SynchronousNormal {
+		err = syncFile(wal.File, wal.Synchronous, &wal.Syncs)
+		if err != nil {
+			return err
+		}
+	}
+	for pageNum, offset := range wal.pending {
+		wal.index[pageNum] = offset
+	}
+	wal.pending = make(map[int32]int64)
+	wal.commitSize = commitSize
+	wal.commitEnd = wal.size
+	wal.commitChecksum = wal.checksum
+	return nil
+}
+
+// Checkpoint copies the latest committed frame of every page back into the
+// database file, truncates it to the committed size and empties the log. It
+// must not run in the middle of a transaction, and waits for the readers of
+// the database to leave.
+func (pager *Pager) Checkpoint() error {
+	if pager.wal == nil {
+		return nil
+	}
+	err := pager.beginWrite()
+	if err == nil {
+		err = pager.lock(LockExclusive)
+	}
+	if err == nil {
+		err = pager.checkpoint()
+	}
+	unlockErr := pager.endTransaction()
+	if err == nil {
+		err = unlockErr
+	}
+	return err
+}
+
+// checkpoint runs a checkpoint under the exclusive lock.
+func (pager *Pager) checkpoint() error {
+	wal := pager.wal
+	if wal.commitSize == 0 {
+		return nil
+	}
+	if wal.Synchronous == SynchronousNormal {
+		// the commits are not synced yet, they must be before the database
+		// file is overwritten
+		err := syncFile(wal.File, wal.Synchronous, &wal.Syncs)
+		if err != nil {
+			return err
+		}
+	}
+	pageNums := make([]int32, 0, len(wal.index))
+	for pageNum := range wal.index {
+		if pageNum < wal.commitSize {
+			pageNums = append(pageNums, pageNum)
+		}
+	}
+	sort.Slice(pageNums, func(i, j int) bool {
+		return pageNums[i] < pageNums[j]
+	})
+	bs := make([]byte, PageSize)
+	for _, pageNum := range pageNums {
+		_, err := wal.readPage(pageNum, bs)
+		if err != nil {
+			return err
+		}
+		_, err = pager.File.WriteAt(bs, int64(PageSize)*int64(pageNum))
+		if err != nil {
+			return err
+		}
+	}
+	err := pager.File.Truncate(int64(PageSize) * int64(wal.commitSize))
+	if err != nil {
+		return err
+	}
+	err = pager.sync(pager.File)
+	if err != nil {
+		return err
+	}
+	pager.FileLength = int64(PageSize) * int64(wal.commitSize)
+	return wal.reset()
+}
+
+// closeWAL checkpoints the log and removes it, unless another connection
+// still has it open.
+func (pager *Pager) closeWAL() error {
+	if pager.wal == nil {
+		return nil
+	}
+	path := pager.wal.path
+	err := pager.wal.File.Lock(LockExclusive)
+	if err == (DBError{Busy}) {
+		pager.wal.File.Close()
+		pager.Syncs += pager.wal.Syncs
+		pager.wal = nil
+		return nil
+	}
+	if err == nil {
+		err = pager.Checkpoint()
+	}
+	if err != nil {
+		return err
+	}
+	pager.wal.File.Close()
+	pager.Syncs += pager.wal.Syncs
+	pager.wal = nil
+	err = pager.vfs.Delete(path)
+	if err != nil {
+		return DBError{DBFileError}
+	}
+	return pager.syncDir(path)
+}
+
+// openWAL opens the log in WAL mode, taking a shared lock on it. In the
+// other modes a log left by a WAL mode connection is checkpointed into the
+// database file and removed, it must not be open by another connection.
+func (pager *Pager) openWAL(opts Options) error {
+	path := walPath(opts.DBPath)
+	if opts.JournalMode != JournalWAL {
+		exists, err := pager.vfs.Exists(path)
+		if err != nil || !exists {
+			return nil
+		}
+	}
+	wal, err := OpenWAL(path, opts)
+	if err != nil {
+		return err
+	}
+	if opts.JournalMode != JournalWAL {
+		err = wal.File.Lock(LockExclusive)
+		if err != nil {
+			wal.File.Close()
+			return err
+		}
+		pager.wal = wal
+		return pager.closeWAL()
+	}
+	err = pager.busyWait(func() error {
+		return wal.File.Lock(LockShared)
+	})
+	if err == nil {
+		// the last connection may have removed the log meanwhile
+		var exists bool
+		exists, err = pager.vfs.Exists(path)
+		if err == nil && !exists {
+			wal.File.Close()
+			return pager.openWAL(opts)
+		}
+	}
+	if err != nil {
+		wal.File.Close()
+		return err
+	}
+	pager.wal = wal
+	return nil
+}
+
+// writeFrames appends pages to the log as frames of the current transaction.
+func (pager *Pager) writeFrames(pages []*Page) error {
+	for _, page := range pages {
+		bs, err := page.ToBytes()
+		if err != nil {
+			return err
+		}
+		data := make([]byte, PageSize)
+		copy(data, bs)
+		err = pager.wal.appendFrame(page.PageNum, data, 0)
+		if err != nil {
+			return err
+		}
+		page.dirty = false
+		pager.PagesWritten++
+	}
+	return nil
+}
+
+// rollback forgets the frames of the current transaction, the next one
+// overwrites them.
+func (wal *WAL) rollback() {
+	wal.pending = make(map[int32]int64)
+	wal.size = wal.commitEnd
+	wal.checksum = wal.commitChecksum
+}